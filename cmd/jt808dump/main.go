@@ -0,0 +1,98 @@
+//jt808dump decode hex frames, such as the frame column of log_frame, into an annotated tree
+//
+//	jt808dump 7E0002000001380012345600014A7E
+//	echo 7E0002000001380012345600014A7E | jt808dump
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"tsp/codec"
+	"tsp/proto"
+	_ "tsp/term"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		for _, arg := range os.Args[1:] {
+			dumpHex(arg)
+		}
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			dumpHex(line)
+		}
+	}
+}
+
+func dumpHex(str string) {
+	str = strings.NewReplacer(" ", "", "0x", "", "0X", "", ",", "").Replace(str)
+	data, err := hex.DecodeString(str)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "err:", err)
+		return
+	}
+	//日志中的帧可能没有标识位
+	if len(data) > 0 && data[0] != proto.ProtoHeader {
+		data = append(append([]byte{proto.ProtoHeader}, data...), proto.ProtoHeader)
+	}
+
+	msgs, _, err := proto.Filter(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "err:", err)
+	}
+	for _, msg := range msgs {
+		dumpMsg(msg)
+	}
+}
+
+func dumpMsg(msg proto.Message) {
+	header := msg.HEADER
+	name := "unknown"
+	if mt, ok := proto.Lookup(header.MID); ok {
+		name = mt.Name
+	}
+
+	edition := "2013"
+	if header.IsVer2019() {
+		edition = "2019"
+	}
+	fmt.Printf("%s(0x%04X) edition:%s phone:%s seq:%d bodylen:%d enc:%d\n",
+		name, header.MID, edition, header.PhoneNum, header.SeqNum, len(msg.BODY), header.EncType())
+	if header.IsMulti() {
+		fmt.Printf("sub-package %d/%d\n", header.MutilFlag.MsgIndex, header.MutilFlag.MsgSum)
+	}
+
+	switch {
+	case header.EncType() != proto.EncNone:
+		fmt.Printf("encrypted body:% X\n\n", msg.BODY)
+		return
+	case header.IsMulti() && header.MutilFlag.MsgSum > 1:
+		fmt.Printf("body:% X\n\n", msg.BODY)
+		return
+	}
+
+	body, err := proto.NewBody(msg)
+	if body == nil {
+		if err != nil {
+			fmt.Println("err:", err)
+		}
+		fmt.Printf("body:% X\n\n", msg.BODY)
+		return
+	}
+
+	fields, err := codec.Dump(msg.BODY, body)
+	fmt.Print(codec.FormatDump(fields))
+	if err != nil {
+		fmt.Println("err:", err)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,151 @@
+package codec
+
+import (
+	"fmt"
+	"time"
+)
+
+//CST is the time zone of jtt808 time fields, GMT+8
+var CST = time.FixedZone("CST", 8*3600)
+
+//BCD2String decode bcd data to digit string
+func BCD2String(data []byte) (string, error) {
+	buff, err := AppendDigits(make([]byte, 0, len(data)*2), data)
+	if err != nil {
+		return "", err
+	}
+	return string(buff), nil
+}
+
+//AppendDigits append the digits of bcd data to dst
+//末尾以0xF补齐的半字节不是数字，如19位的ICCID
+func AppendDigits(dst []byte, data []byte) ([]byte, error) {
+	for i, item := range data {
+		high := item >> 4
+		low := item & 0x0F
+		if high > 9 || low > 9 {
+			if !fPadding(item, data[i+1:]) {
+				return dst, fmt.Errorf("bad bcd byte:%02X", item)
+			}
+			if high <= 9 {
+				dst = append(dst, '0'+high)
+			}
+			return dst, nil
+		}
+		dst = append(dst, '0'+high, '0'+low)
+	}
+	return dst, nil
+}
+
+//fPadding return true if item and rest are 0xF padding after the last digit
+func fPadding(item byte, rest []byte) bool {
+	if item&0x0F != 0x0F || (item>>4 > 9 && item>>4 != 0x0F) {
+		return false
+	}
+	for _, b := range rest {
+		if b != 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+//AppendBCD append digit string s to dst as n bytes bcd
+//不足n字节时前补0，超出时保留末尾的数字
+func AppendBCD(dst []byte, s string, n int) ([]byte, error) {
+	if len(s) > n*2 {
+		s = s[len(s)-n*2:]
+	}
+
+	var err error
+	var item byte
+	for i := 0; i < n*2; i++ {
+		var digit byte
+		index := i - (n*2 - len(s))
+		if index >= 0 {
+			digit = s[index] - '0'
+			if digit > 9 {
+				err = fmt.Errorf("bad digit:%c", s[index])
+				digit = 0
+			}
+		}
+
+		if i%2 == 0 {
+			item = digit << 4
+		} else {
+			dst = append(dst, item|digit)
+		}
+	}
+	return dst, err
+}
+
+//String2BCD encode digit string s to n bytes bcd
+func String2BCD(s string, n int) ([]byte, error) {
+	if len(s) > n*2 {
+		return []byte{}, fmt.Errorf("%s is longer than %d bcd bytes", s, n)
+	}
+	return AppendBCD(make([]byte, 0, n), s, n)
+}
+
+//BCD2Time decode YYMMDDhhmmss bcd time in GMT+8
+//全0表示没有时间，返回time.Time零值
+func BCD2Time(data []byte) (time.Time, error) {
+	if len(data) < 6 {
+		return time.Time{}, fmt.Errorf("data to short")
+	}
+
+	var fields [6]int
+	var zero bool = true
+	for i := range fields {
+		high := data[i] >> 4
+		low := data[i] & 0x0F
+		if high > 9 || low > 9 {
+			return time.Time{}, fmt.Errorf("bad bcd byte:%02X", data[i])
+		}
+		fields[i] = int(high)*10 + int(low)
+		if fields[i] != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		return time.Time{}, nil
+	}
+
+	stamp := time.Date(2000+fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], 0, CST)
+	if stamp.Month() != time.Month(fields[1]) || stamp.Day() != fields[2] ||
+		stamp.Hour() != fields[3] || stamp.Minute() != fields[4] || stamp.Second() != fields[5] {
+		return time.Time{}, fmt.Errorf("bad bcd time:%X", data[:6])
+	}
+	return stamp, nil
+}
+
+//Time2BCD encode t to YYMMDDhhmmss bcd time in GMT+8, time.Time零值编码为全0
+func Time2BCD(t time.Time) []byte {
+	if t.IsZero() {
+		return make([]byte, 6)
+	}
+	data, _ := String2BCD(t.In(CST).Format("060102150405"), 6)
+	return data
+}
+
+//BCDTime is a time field sent as YYMMDDhhmmss bcd in GMT+8
+type BCDTime struct {
+	time.Time
+}
+
+func (t BCDTime) MarshalJT808() ([]byte, error) {
+	return Time2BCD(t.Time), nil
+}
+
+func (t *BCDTime) UnmarshalJT808(data []byte) (int, error) {
+	stamp, err := BCD2Time(data)
+	if err != nil {
+		return 0, err
+	}
+	t.Time = stamp
+	return 6, nil
+}
+
+func (t BCDTime) SizeJT808() int {
+	return 6
+}
@@ -0,0 +1,123 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//parseBits parse the bit:"n" or bits:"lo-hi" tag of a field in a bit-field struct,
+//bits:"all"表示保存整个原始字
+func parseBits(tag *fieldTag, field reflect.StructField) error {
+	bit, bits := field.Tag.Get("bit"), field.Tag.Get("bits")
+	switch {
+	case bit != "":
+		n, err := strconv.ParseUint(bit, 10, 6)
+		if err != nil {
+			return err
+		}
+		tag.bitLo, tag.bitHi = int(n), int(n)
+	case bits == "all":
+		tag.bitAll = true
+	case bits != "":
+		parts := strings.Split(bits, "-")
+		if len(parts) != 2 {
+			return fmt.Errorf("bad bits tag:%s", bits)
+		}
+		lo, err := strconv.ParseUint(parts[0], 10, 6)
+		if err != nil {
+			return err
+		}
+		hi, err := strconv.ParseUint(parts[1], 10, 6)
+		if err != nil {
+			return err
+		}
+		if lo > hi {
+			return fmt.Errorf("bad bits tag:%s", bits)
+		}
+		tag.bitLo, tag.bitHi = int(lo), int(hi)
+	}
+	return nil
+}
+
+//bitMask return the mask of the bits lo-hi
+func bitMask(lo, hi int) uint64 {
+	return (^uint64(0) >> uint(63-hi+lo)) << uint(lo)
+}
+
+//refUnmarshalBits decode a bit-field word into the struct v
+func refUnmarshalBits(data []byte, v reflect.Value, tag *fieldTag, order binary.ByteOrder) (int, error) {
+	if len(data) < tag.bitfield {
+		return 0, fmt.Errorf("data to short,%s need %d bytes", tag.name, tag.bitfield)
+	}
+	if v.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("bitfield %s must be a struct", tag.name)
+	}
+	plan, err := getPlan(v.Type())
+	if err != nil {
+		return 0, err
+	}
+
+	word := readUint(data, tag.bitfield, order)
+	for i, field := range plan.fields {
+		fv := v.Field(i)
+		if field.tag.bitAll {
+			fv.SetUint(word)
+			continue
+		}
+		if field.tag.bitLo < 0 {
+			continue
+		}
+
+		value := (word & bitMask(field.tag.bitLo, field.tag.bitHi)) >> uint(field.tag.bitLo)
+		switch fv.Kind() {
+		case reflect.Bool:
+			fv.SetBool(value != 0)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fv.SetUint(value)
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fv.SetInt(int64(value))
+		}
+	}
+	return tag.bitfield, nil
+}
+
+//refMarshalBits append the struct v as a bit-field word,
+//bits:"all"字段中没有命名的位原样保留
+func refMarshalBits(data []byte, v reflect.Value, tag *fieldTag, order binary.ByteOrder) ([]byte, error) {
+	if v.Kind() != reflect.Struct {
+		return data, fmt.Errorf("bitfield %s must be a struct", tag.name)
+	}
+	plan, err := getPlan(v.Type())
+	if err != nil {
+		return data, err
+	}
+
+	var word uint64
+	for i, field := range plan.fields {
+		fv := v.Field(i)
+		if field.tag.bitAll {
+			word |= fv.Uint() &^ plan.bitMask
+			continue
+		}
+		if field.tag.bitLo < 0 {
+			continue
+		}
+
+		var value uint64
+		switch fv.Kind() {
+		case reflect.Bool:
+			if fv.Bool() {
+				value = 1
+			}
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			value = fv.Uint()
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			value = uint64(fv.Int())
+		}
+		word |= (value << uint(field.tag.bitLo)) & bitMask(field.tag.bitLo, field.tag.bitHi)
+	}
+	return appendUint(data, word, tag.bitfield, order), nil
+}
@@ -1,21 +1,32 @@
 package codec
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"reflect"
-	"strconv"
+	"time"
 )
 
+//timeType is encoded as YYMMDDhhmmss bcd time
+var timeType = reflect.TypeOf(time.Time{})
+
 func RequireLen(v interface{}) (int, error) {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return 0, fmt.Errorf("error")
 	}
 
-	return refRequireLen(reflect.ValueOf(v), reflect.StructField{})
+	return typeRequireLen(rv.Type(), noTag)
 }
 
 func Unmarshal(data []byte, v interface{}) (int, error) {
+	return UnmarshalOrder(data, v, binary.BigEndian)
+}
+
+//UnmarshalOrder is Unmarshal with the byte order of integers,
+//字段的order标签优先
+func UnmarshalOrder(data []byte, v interface{}, order binary.ByteOrder) (int, error) {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return 0, fmt.Errorf("error")
@@ -30,171 +41,195 @@ func Unmarshal(data []byte, v interface{}) (int, error) {
 		return 0, fmt.Errorf("data too short,datalen:%d,lens:%d", len(data), lens)
 	}
 
-	return refUnmarshal(data, reflect.ValueOf(v), reflect.StructField{}, len(data)-lens)
+	return refUnmarshal(data, rv, noTag, len(data)-lens, order)
 }
 
 func Marshal(v interface{}) ([]byte, error) {
+	return MarshalOrder(v, binary.BigEndian)
+}
+
+//MarshalOrder is Marshal with the byte order of integers
+func MarshalOrder(v interface{}, order binary.ByteOrder) ([]byte, error) {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return []byte{}, fmt.Errorf("error")
 	}
 
-	return refMarshal(reflect.ValueOf(v), reflect.StructField{})
+	data, err := refMarshal(make([]byte, 0, 64), rv, noTag, order)
+	if err != nil {
+		return []byte{}, err
+	}
+	return data, nil
 }
 
-func refRequireLen(v reflect.Value, tag reflect.StructField) (int, error) {
-	var usedLen int = 0
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
+//typeRequireLen return the least encoded length of type t
+func typeRequireLen(t reflect.Type, tag *fieldTag) (int, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
 	}
-	switch v.Kind() {
-	case reflect.Int8:
-		usedLen = usedLen + 1
-	case reflect.Uint8:
-		usedLen = usedLen + 1
-	case reflect.Int16:
-		usedLen = usedLen + 2
-	case reflect.Uint16:
-		usedLen = usedLen + 2
-	case reflect.Int32:
-		usedLen = usedLen + 4
-	case reflect.Uint32:
-		usedLen = usedLen + 4
-	case reflect.Int64:
-		usedLen = usedLen + 8
-	case reflect.Uint64:
-		usedLen = usedLen + 8
-	case reflect.Float32:
-		usedLen = usedLen + 4
-	case reflect.Float64:
-		usedLen = usedLen + 8
-	case reflect.String:
-		strLen := tag.Tag.Get("len")
-		if strLen == "" {
-			return 0, nil
-		}
-		lens, err := strconv.ParseInt(strLen, 10, 0)
-		if err != nil {
-			return 0, err
-		}
-
-		usedLen = usedLen + int(lens)
-	case reflect.Slice:
-		strLen := tag.Tag.Get("len")
-		if strLen == "" {
-			return 0, nil
+	if t == timeType {
+		return 6, nil
+	}
+	if isCustom(t) {
+		if n := varRequireLen(tag); n > 0 {
+			return n, nil
 		}
-		lens, err := strconv.ParseInt(strLen, 10, 0)
+		return customSize(t), nil
+	}
+	if tag.tlv != nil {
+		return 0, nil
+	}
+	if tag.bitfield > 0 {
+		return tag.bitfield, nil
+	}
+	if t.Kind() == reflect.Struct && tag.prefix > 0 {
+		return tag.prefix, nil
+	}
+	if isList(t) {
+		return 0, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16,
+		reflect.Int32, reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return int(t.Size()), nil
+	case reflect.String, reflect.Slice:
+		return varRequireLen(tag), nil
+	case reflect.Struct:
+		plan, err := getPlan(t)
 		if err != nil {
 			return 0, err
 		}
-
-		usedLen = usedLen + int(lens)
-	case reflect.Struct:
-		fieldCount := v.NumField()
-
-		for i := 0; i < fieldCount; i++ {
-			l, err := refRequireLen(v.Field(i), v.Type().Field(i))
-			if err != nil {
-				return 0, err
-			}
-
-			usedLen = usedLen + l
-		}
+		return plan.restLen[0], nil
 	}
-	return usedLen, nil
+	return 0, nil
 }
 
-func refUnmarshal(data []byte, v reflect.Value, tag reflect.StructField, streLen int) (int, error) {
+func refUnmarshal(data []byte, v reflect.Value, tag *fieldTag, streLen int, order binary.ByteOrder) (int, error) {
 	var usedLen int = 0
+	if tag.order != nil {
+		order = tag.order
+	}
 	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
 		v = v.Elem()
 	}
-	switch v.Kind() {
-	case reflect.Int8:
-		v.SetInt(int64(data[0]))
-		usedLen = usedLen + 1
-	case reflect.Uint8:
-		v.SetUint(uint64(data[0]))
-		usedLen = usedLen + 1
-	case reflect.Int16:
-		if len(data) < 2 {
-			return 0, fmt.Errorf("data to short")
+	if u, ok := asUnmarshaler(v, tag); ok {
+		return unmarshalCustom(data, u, v.Type(), tag, streLen, order)
+	}
+	if v.Type() == timeType {
+		var stamp BCDTime
+		if _, err := stamp.UnmarshalJT808(data); err != nil {
+			return 0, err
 		}
-		v.SetInt(int64(Bytes2Word(data)))
-		usedLen = usedLen + 2
-	case reflect.Uint16:
-		if len(data) < 2 {
+		v.Set(reflect.ValueOf(stamp.Time))
+		return 6, nil
+	}
+	//tlv字段解析到数据结束
+	if tag.tlv != nil {
+		if streLen < 0 || len(data) < streLen {
 			return 0, fmt.Errorf("data to short")
 		}
-		v.SetUint(uint64(Bytes2Word(data)))
-		usedLen = usedLen + 2
-	case reflect.Int32:
-		if len(data) < 4 {
-			return 0, fmt.Errorf("data to short")
+		return refUnmarshalTLV(data[:streLen], v, tag, order)
+	}
+	if tag.bitfield > 0 {
+		return refUnmarshalBits(data, v, tag, order)
+	}
+	//带长度前缀的结构体只在前缀给出的长度内解析
+	if v.Kind() == reflect.Struct && tag.prefix > 0 {
+		raw, lens, err := fieldBytes(data, tag, streLen, order)
+		if err != nil {
+			return 0, err
 		}
-		v.SetInt(int64(Bytes2DWord(data)))
-		usedLen = usedLen + 4
-	case reflect.Uint32:
-		if len(data) < 4 {
-			return 0, fmt.Errorf("data to short")
+		inner, err := typeRequireLen(v.Type(), noTag)
+		if err != nil {
+			return 0, err
 		}
-		v.SetUint(uint64(Bytes2DWord(data)))
-		usedLen = usedLen + 4
-	case reflect.Int64:
-		v.SetInt(64)
-		usedLen = usedLen + 8
-	case reflect.Uint64:
-		v.SetUint(64)
-		usedLen = usedLen + 8
-	case reflect.Float32:
-		v.SetFloat(32.23)
-		usedLen = usedLen + 4
-	case reflect.Float64:
-		v.SetFloat(64.46)
-		usedLen = usedLen + 8
-	case reflect.String:
-		strLen := tag.Tag.Get("len")
-		var lens int = 0
-		if strLen == "" {
-			lens = streLen
-		} else {
-			lens64, err := strconv.ParseInt(strLen, 10, 0)
-			if err != nil {
-				return 0, err
-			}
-
-			lens = int(lens64)
+		if len(raw) < inner {
+			return 0, fmt.Errorf("data to short,%s:%d", tag.name, len(raw))
+		}
+		if _, err = refUnmarshal(raw, v, noTag, len(raw)-inner, order); err != nil {
+			return 0, err
+		}
+		return lens, nil
+	}
+	if isList(v.Type()) {
+		return refUnmarshalList(data, v, -1, streLen, order)
+	}
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16,
+		reflect.Int32, reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Float32, reflect.Float64:
+		size := int(v.Type().Size())
+		if len(data) < size {
+			return 0, fmt.Errorf("data to short,%s need %d bytes", v.Kind(), size)
 		}
 
-		if len(data) < int(lens) {
-			return 0, fmt.Errorf("data to short")
+		n := readUint(data, size, order)
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(n != 0)
+		case reflect.Int8:
+			v.SetInt(int64(int8(n)))
+		case reflect.Int16:
+			v.SetInt(int64(int16(n)))
+		case reflect.Int32:
+			v.SetInt(int64(int32(n)))
+		case reflect.Int64:
+			v.SetInt(int64(n))
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(n)
+		case reflect.Float32:
+			v.SetFloat(float64(math.Float32frombits(uint32(n))))
+		case reflect.Float64:
+			v.SetFloat(math.Float64frombits(n))
+		}
+		usedLen = usedLen + size
+	case reflect.String:
+		raw, lens, err := fieldBytes(data, tag, streLen, order)
+		if err != nil {
+			return 0, err
 		}
 
-		v.SetString(string(data[:lens]))
-		usedLen = usedLen + int(lens)
+		str, err := decodeString(raw, tag.enc)
+		if err != nil {
+			return 0, err
+		}
+		v.SetString(str)
+		usedLen = usedLen + lens
 
 	case reflect.Slice:
-		strLen := tag.Tag.Get("len")
-		var lens int = 0
-		if strLen == "" {
-			lens = streLen
-		} else {
-			lens64, err := strconv.ParseInt(strLen, 10, 0)
-			if err != nil {
-				return 0, err
-			}
-
-			lens = int(lens64)
+		raw, lens, err := fieldBytes(data, tag, streLen, order)
+		if err != nil {
+			return 0, err
 		}
 
-		v.SetBytes(data[:lens])
-		usedLen = usedLen + int(lens)
+		v.SetBytes(raw)
+		usedLen = usedLen + lens
 	case reflect.Struct:
-		fieldCount := v.NumField()
+		plan, err := getPlan(v.Type())
+		if err != nil {
+			return 0, err
+		}
+		total := plan.restLen[0] + streLen
 
-		for i := 0; i < fieldCount; i++ {
-			l, err := refUnmarshal(data[usedLen:], v.Field(i), v.Type().Field(i), streLen)
+		for i, field := range plan.fields {
+			fieldLen := total - usedLen - plan.restLen[i]
+			//lenfield字段的长度由前面的长度字段给出
+			if field.tag.lenField >= 0 {
+				fieldLen = intValue(v.Field(field.tag.lenField))
+			}
+			//countfield字段的元素个数由前面的计数字段给出
+			if field.tag.countField >= 0 {
+				n := intValue(v.Field(field.tag.countField))
+				l, err := refUnmarshalList(data[usedLen:], v.Field(i), n, fieldLen, order)
+				if err != nil {
+					return 0, err
+				}
+				usedLen = usedLen + l
+				continue
+			}
+			l, err := refUnmarshal(data[usedLen:], v.Field(i), field.tag, fieldLen, order)
 			if err != nil {
 				return 0, err
 			}
@@ -205,76 +240,127 @@ func refUnmarshal(data []byte, v reflect.Value, tag reflect.StructField, streLen
 	return usedLen, nil
 }
 
-func refMarshal(v reflect.Value, tag reflect.StructField) ([]byte, error) {
-	data := make([]byte, 0)
+//unmarshalCustom decode a field by its Unmarshaler,
+//有len、prefix或zeroend标签时只传入该字段的数据，否则传入该字段可用的全部数据
+func unmarshalCustom(data []byte, u Unmarshaler, t reflect.Type, tag *fieldTag, streLen int, order binary.ByteOrder) (int, error) {
+	if tag.fixed >= 0 || tag.prefix > 0 || tag.zeroend {
+		raw, lens, err := fieldBytes(data, tag, 0, order)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = u.UnmarshalJT808(raw); err != nil {
+			return 0, err
+		}
+		return lens, nil
+	}
+
+	avail := customSize(t) + streLen
+	if avail < 0 || avail > len(data) {
+		avail = len(data)
+	}
+	n, err := u.UnmarshalJT808(data[:avail])
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > avail {
+		return 0, fmt.Errorf("%s used %d bytes of %d", t, n, avail)
+	}
+	return n, nil
+}
+
+//refMarshal append the encoded v to data
+func refMarshal(data []byte, v reflect.Value, tag *fieldTag, order binary.ByteOrder) ([]byte, error) {
+	if tag.order != nil {
+		order = tag.order
+	}
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
+	if m, ok := asMarshaler(v, tag); ok {
+		content, err := m.MarshalJT808()
+		if err != nil {
+			return data, err
+		}
+		return wrapField(data, content, tag, order)
+	}
+	if v.Type() == timeType {
+		return append(data, Time2BCD(v.Interface().(time.Time))...), nil
+	}
+	if tag.tlv != nil {
+		return refMarshalTLV(data, v, tag, order)
+	}
+	if tag.bitfield > 0 {
+		return refMarshalBits(data, v, tag, order)
+	}
+	if v.Kind() == reflect.Struct && tag.prefix > 0 {
+		start := len(data)
+		data = appendUint(data, 0, tag.prefix, order)
+		data, err := refMarshal(data, v, noTag, order)
+		if err != nil {
+			return data, err
+		}
+		return patchPrefix(data, start, tag, order)
+	}
+	if isList(v.Type()) {
+		return refMarshalList(data, v, order)
+	}
 	switch v.Kind() {
-	case reflect.Int8:
-		data = append(data, byte(v.Int()))
-	case reflect.Uint8:
-		data = append(data, byte(v.Uint()))
-	case reflect.Int16:
-		temp := Word2Bytes(uint16(v.Int()))
-		data = append(data, temp...)
-	case reflect.Uint16:
-		temp := Word2Bytes(uint16(v.Uint()))
-		data = append(data, temp...)
-	case reflect.Int32:
-		temp := Dword2Bytes(uint32(v.Int()))
-		data = append(data, temp...)
-	case reflect.Uint32:
-		temp := Dword2Bytes(uint32(v.Uint()))
-		data = append(data, temp...)
-	case reflect.String:
-		strLen := tag.Tag.Get("len")
-		var lens int = 0
-		if strLen == "" {
-			lens = v.Len()
+	case reflect.Bool:
+		if v.Bool() {
+			data = append(data, 1)
 		} else {
-			lens64, err := strconv.ParseInt(strLen, 10, 0)
-			if err != nil {
-				return []byte{}, err
-			}
-
-			lens = int(lens64)
+			data = append(data, 0)
 		}
-
-		if int(lens) > v.Len() {
-			zeroSlice := make([]byte, int(lens)-v.Len())
-			data = append(data, zeroSlice...)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		data = appendUint(data, uint64(v.Int()), int(v.Type().Size()), order)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		data = appendUint(data, v.Uint(), int(v.Type().Size()), order)
+	case reflect.Float32:
+		data = appendUint(data, uint64(math.Float32bits(float32(v.Float()))), 4, order)
+	case reflect.Float64:
+		data = appendUint(data, math.Float64bits(v.Float()), 8, order)
+	case reflect.String:
+		temp, err := encodeString(v.String(), tag.enc, tag.fixed)
+		if err != nil {
+			return data, err
 		}
-		data = append(data, v.String()...)
+		return wrapField(data, temp, tag, order)
 	case reflect.Slice:
-		strLen := tag.Tag.Get("len")
-		var lens int = 0
-		if strLen == "" {
-			lens = v.Len()
-		} else {
-			lens64, err := strconv.ParseInt(strLen, 10, 0)
-			if err != nil {
-				return []byte{}, err
-			}
-
-			lens = int(lens64)
-		}
-
-		if int(lens) > v.Len() {
-			zeroSlice := make([]byte, int(lens)-v.Len())
+		if tag.fixed > v.Len() {
+			zeroSlice := make([]byte, tag.fixed-v.Len())
 			data = append(data, zeroSlice...)
 		}
-		data = append(data, v.Bytes()...)
+		return wrapField(data, v.Bytes(), tag, order)
 	case reflect.Struct:
-		fieldCount := v.NumField()
+		plan, err := getPlan(v.Type())
+		if err != nil {
+			return data, err
+		}
 
-		for i := 0; i < fieldCount; i++ {
-			d, err := refMarshal(v.Field(i), v.Type().Field(i))
+		offsets := make([]int, len(plan.fields)+1)
+		for i, field := range plan.fields {
+			offsets[i] = len(data)
+			data, err = refMarshal(data, v.Field(i), field.tag, order)
 			if err != nil {
-				return []byte{}, err
+				return data, err
+			}
+		}
+		offsets[len(plan.fields)] = len(data)
+
+		//长度字段按lenfield字段的实际长度填写，计数字段按countfield字段的元素个数填写
+		for i, field := range plan.fields {
+			var index, n int
+			if field.tag.lenField >= 0 {
+				index, n = field.tag.lenField, offsets[i+1]-offsets[i]
+			} else if field.tag.countField >= 0 {
+				index, n = field.tag.countField, v.Field(i).Len()
+			} else {
+				continue
+			}
+			lenTag := plan.fields[index].tag
+			if err := setLenField(data[offsets[index]:offsets[index+1]], plan.fields[index], n, lenTag.byteOrder(order)); err != nil {
+				return data, err
 			}
-
-			data = append(data, d...)
 		}
 	}
 	return data, nil
@@ -309,3 +395,61 @@ func Dword2Bytes(data uint32) []byte {
 	buff[3] = byte(data)
 	return buff
 }
+
+func Bytes2QWord(data []byte) uint64 {
+	if len(data) < 8 {
+		return 0
+	}
+	return (uint64(Bytes2DWord(data)) << 32) + uint64(Bytes2DWord(data[4:]))
+}
+
+func Qword2Bytes(data uint64) []byte {
+	buff := make([]byte, 8)
+	copy(buff, Dword2Bytes(uint32(data>>32)))
+	copy(buff[4:], Dword2Bytes(uint32(data)))
+	return buff
+}
+
+//readUint read a size bytes unsigned integer in order
+func readUint(data []byte, size int, order binary.ByteOrder) uint64 {
+	switch size {
+	case 1:
+		return uint64(data[0])
+	case 2:
+		return uint64(order.Uint16(data))
+	case 4:
+		return uint64(order.Uint32(data))
+	case 8:
+		return order.Uint64(data)
+	}
+	return 0
+}
+
+//appendUint append the low size bytes of n in order
+func appendUint(data []byte, n uint64, size int, order binary.ByteOrder) []byte {
+	switch order {
+	case binary.BigEndian:
+		for i := size - 1; i >= 0; i-- {
+			data = append(data, byte(n>>(8*uint(i))))
+		}
+		return data
+	case binary.LittleEndian:
+		for i := 0; i < size; i++ {
+			data = append(data, byte(n>>(8*uint(i))))
+		}
+		return data
+	}
+
+	buff := make([]byte, 8)
+	switch size {
+	case 1:
+		buff[0] = byte(n)
+	case 2:
+		order.PutUint16(buff, uint16(n))
+	case 4:
+		order.PutUint32(buff, uint32(n))
+	case 8:
+		order.PutUint64(buff, n)
+	}
+	return append(data, buff[:size]...)
+}
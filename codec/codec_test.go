@@ -1,7 +1,13 @@
 package codec
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestUnmarshal(t *testing.T) {
@@ -70,3 +76,654 @@ func TestMarshal(t *testing.T) {
 	t.Log("data:", data)
 	t.Log("pack:", pack)
 }
+
+func TestBCD(t *testing.T) {
+	str, err := BCD2String([]byte{0x01, 0x38, 0x00, 0x12, 0x34, 0x56})
+	if err != nil || str != "013800123456" {
+		t.Errorf("str:%s, err:%v", str, err)
+	}
+	if _, err = BCD2String([]byte{0x1A}); err == nil {
+		t.Errorf("bad bcd should fail")
+	}
+
+	//末尾0xF补齐
+	for data, want := range map[string]string{
+		"\x89\x86\x01\x23\x45\x67\x89\x01\x23\x4F": "8986012345678901234",
+		"\x12\x3F\xFF": "123",
+		"\x12\xFF":     "12",
+	} {
+		if str, err = BCD2String([]byte(data)); err != nil || str != want {
+			t.Errorf("padded:%x str:%s, err:%v", data, str, err)
+		}
+	}
+	for _, data := range [][]byte{{0xF1}, {0x1F, 0x23}, {0x1F, 0xF0}, {0xAF}} {
+		if _, err = BCD2String(data); err == nil {
+			t.Errorf("data:%x should fail", data)
+		}
+	}
+
+	data, err := String2BCD("13800123456", 10)
+	if err != nil || !bytes.Equal(data, []byte{0x00, 0x00, 0x00, 0x00, 0x01, 0x38, 0x00, 0x12, 0x34, 0x56}) {
+		t.Errorf("data:%x, err:%v", data, err)
+	}
+	if _, err = String2BCD("1234567", 3); err == nil {
+		t.Errorf("long string should fail")
+	}
+	if _, err = String2BCD("12a4", 2); err == nil {
+		t.Errorf("bad digit should fail")
+	}
+}
+
+func TestBCDTime(t *testing.T) {
+	stamp, err := BCD2Time([]byte{0x20, 0x02, 0x29, 0x23, 0x59, 0x08})
+	if err != nil || !stamp.Equal(time.Date(2020, 2, 29, 23, 59, 8, 0, CST)) {
+		t.Errorf("stamp:%v, err:%v", stamp, err)
+	}
+	if !bytes.Equal(Time2BCD(stamp.UTC()), []byte{0x20, 0x02, 0x29, 0x23, 0x59, 0x08}) {
+		t.Errorf("bcd:%x", Time2BCD(stamp))
+	}
+
+	for _, data := range [][]byte{
+		{0x19, 0x02, 0x29, 0x00, 0x00, 0x00},
+		{0x20, 0x13, 0x01, 0x00, 0x00, 0x00},
+		{0x20, 0x01, 0x01, 0x24, 0x00, 0x00},
+		{0x20, 0x01, 0x01, 0x00, 0x0A, 0x00},
+		{0x20, 0x01, 0x01},
+	} {
+		if _, err = BCD2Time(data); err == nil {
+			t.Errorf("data:%x should fail", data)
+		}
+	}
+
+	stamp, err = BCD2Time(make([]byte, 6))
+	if err != nil || !stamp.IsZero() || !bytes.Equal(Time2BCD(stamp), make([]byte, 6)) {
+		t.Errorf("zero stamp:%v, err:%v", stamp, err)
+	}
+
+	type Body struct {
+		Speed uint16
+		Time  time.Time
+		Dir   uint16
+	}
+
+	pack := Body{Speed: 60, Time: time.Date(2019, 12, 31, 8, 0, 1, 0, CST), Dir: 90}
+	data, err := Marshal(&pack)
+	if err != nil || !bytes.Equal(data, []byte{0x00, 0x3C, 0x19, 0x12, 0x31, 0x08, 0x00, 0x01, 0x00, 0x5A}) {
+		t.Fatalf("data:%x, err:%v", data, err)
+	}
+
+	var out Body
+	if _, err = Unmarshal(data, &out); err != nil || out.Speed != pack.Speed || !out.Time.Equal(pack.Time) || out.Dir != pack.Dir {
+		t.Errorf("out:%+v, err:%v", out, err)
+	}
+
+	data[3] = 0x13
+	if _, err = Unmarshal(data, &out); err == nil {
+		t.Errorf("bad time should fail")
+	}
+}
+
+func TestEnc(t *testing.T) {
+	type Body struct {
+		Phone string `len:"6" enc:"bcd"`
+		Manuf string `len:"5" enc:"gbk"`
+		Model string `len:"4"`
+		Plate string `enc:"gbk"`
+	}
+
+	pack := Body{Phone: "13800123456", Manuf: "ABC", Model: "X1", Plate: "粤B12345"}
+	data, err := Marshal(&pack)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+
+	want := []byte{0x01, 0x38, 0x00, 0x12, 0x34, 0x56, 'A', 'B', 'C', 0x00, 0x00, 0x00, 0x00, 'X', '1', 0xD4, 0xC1, 'B', '1', '2', '3', '4', '5'}
+	if !bytes.Equal(data, want) {
+		t.Errorf("data:%x", data)
+	}
+
+	var out Body
+	if _, err = Unmarshal(data, &out); err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if out.Phone != "013800123456" || out.Manuf != "ABC" || out.Plate != "粤B12345" {
+		t.Errorf("out:%+v", out)
+	}
+
+	pack.Manuf = "ABCDEF"
+	if _, err = Marshal(&pack); err == nil {
+		t.Errorf("long gbk string should fail")
+	}
+
+	data[0] = 0xAB
+	if _, err = Unmarshal(data, &out); err == nil {
+		t.Errorf("bad bcd should fail")
+	}
+}
+
+func TestVarLen(t *testing.T) {
+	type Body struct {
+		KeyLen uint8
+		Key    string `lenfield:"KeyLen"`
+		Imei   string `len:"4"`
+		Name   string `prefix:"u8"`
+		Data   []byte `prefix:"u16"`
+		Ver    string `zeroend:"true"`
+		Tail   uint16
+	}
+
+	pack := Body{Key: "auth", Imei: "1234", Name: "ab", Data: []byte{0x01, 0x02, 0x03}, Ver: "v1", Tail: 0x1122}
+	data, err := Marshal(&pack)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+
+	want := []byte{0x04, 'a', 'u', 't', 'h', '1', '2', '3', '4', 0x02, 'a', 'b', 0x00, 0x03, 0x01, 0x02, 0x03, 'v', '1', 0x00, 0x11, 0x22}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("data:%x", data)
+	}
+
+	var out Body
+	used, err := Unmarshal(data, &out)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	pack.KeyLen = 4
+	if used != len(data) || out.Key != pack.Key || out.KeyLen != 4 || out.Name != pack.Name ||
+		!bytes.Equal(out.Data, pack.Data) || out.Ver != pack.Ver || out.Tail != pack.Tail {
+		t.Errorf("used:%d out:%+v", used, out)
+	}
+
+	if _, err = Unmarshal(data[:12], &out); err == nil {
+		t.Errorf("short prefix data should fail")
+	}
+	if _, err = Unmarshal(data[:19], &out); err == nil {
+		t.Errorf("missing terminator should fail")
+	}
+
+	pack.Name = string(make([]byte, 256))
+	if _, err = Marshal(&pack); err == nil {
+		t.Errorf("long prefix field should fail")
+	}
+}
+
+func TestList(t *testing.T) {
+	type Item struct {
+		ID   uint32
+		Data []byte `prefix:"u8"`
+	}
+	type Point struct {
+		Lat uint32
+		Ext []byte
+	}
+	type Wrap struct {
+		Info Point `prefix:"u16"`
+	}
+	type Body struct {
+		Count uint8
+		Items []Item `countfield:"Count"`
+		Wraps []Wrap
+	}
+
+	pack := Body{
+		Items: []Item{{ID: 1, Data: []byte{0xAA}}, {ID: 2}},
+		Wraps: []Wrap{{Info: Point{Lat: 3, Ext: []byte{0x01, 0x02}}}, {Info: Point{Lat: 4}}},
+	}
+	data, err := Marshal(&pack)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+
+	want := []byte{0x02,
+		0x00, 0x00, 0x00, 0x01, 0x01, 0xAA,
+		0x00, 0x00, 0x00, 0x02, 0x00,
+		0x00, 0x06, 0x00, 0x00, 0x00, 0x03, 0x01, 0x02,
+		0x00, 0x04, 0x00, 0x00, 0x00, 0x04}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("data:%x", data)
+	}
+
+	var out Body
+	used, err := Unmarshal(data, &out)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if used != len(data) || out.Count != 2 || len(out.Items) != 2 || len(out.Wraps) != 2 {
+		t.Fatalf("used:%d out:%+v", used, out)
+	}
+	if out.Items[0].ID != 1 || !bytes.Equal(out.Items[0].Data, []byte{0xAA}) || out.Items[1].ID != 2 {
+		t.Errorf("items:%+v", out.Items)
+	}
+	if out.Wraps[0].Info.Lat != 3 || !bytes.Equal(out.Wraps[0].Info.Ext, []byte{0x01, 0x02}) ||
+		out.Wraps[1].Info.Lat != 4 || len(out.Wraps[1].Info.Ext) != 0 {
+		t.Errorf("wraps:%+v", out.Wraps)
+	}
+
+	data[0] = 3
+	if _, err = Unmarshal(data[:12], &out); err == nil {
+		t.Errorf("missing item should fail")
+	}
+
+	length, err := RequireLen(&out)
+	if err != nil || length != 1 {
+		t.Errorf("require len:%d err:%v", length, err)
+	}
+}
+
+func TestTLV(t *testing.T) {
+	type Extra struct {
+		Mileage *uint32          `tlvid:"0x01"`
+		Signal  *uint8           `tlvid:"0x30"`
+		Name    *string          `tlvid:"0x40"`
+		Other   map[uint8][]byte `tlvid:"*"`
+	}
+	type Body struct {
+		Lat   uint32
+		Extra Extra `tlv:"u8,u8"`
+	}
+
+	data := []byte{0x00, 0x00, 0x00, 0x01,
+		0x30, 0x01, 0x1F,
+		0x01, 0x04, 0x00, 0x00, 0x01, 0x00,
+		0xE1, 0x02, 0xAA, 0xBB,
+		0x40, 0x02, 'a', 'b'}
+
+	var out Body
+	used, err := Unmarshal(data, &out)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if used != len(data) || out.Lat != 1 {
+		t.Fatalf("used:%d out:%+v", used, out)
+	}
+	extra := out.Extra
+	if extra.Mileage == nil || *extra.Mileage != 256 || extra.Signal == nil || *extra.Signal != 0x1F ||
+		extra.Name == nil || *extra.Name != "ab" || !bytes.Equal(extra.Other[0xE1], []byte{0xAA, 0xBB}) {
+		t.Errorf("extra:%+v", extra)
+	}
+
+	//重新编码时按ID排序
+	repack, err := Marshal(&out)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	want := []byte{0x00, 0x00, 0x00, 0x01,
+		0x01, 0x04, 0x00, 0x00, 0x01, 0x00,
+		0x30, 0x01, 0x1F,
+		0x40, 0x02, 'a', 'b',
+		0xE1, 0x02, 0xAA, 0xBB}
+	if !bytes.Equal(repack, want) {
+		t.Errorf("repack:%x", repack)
+	}
+
+	var raw struct {
+		Items map[uint8][]byte `tlv:"u8,u8"`
+	}
+	if _, err = Unmarshal(data[4:], &raw); err != nil || len(raw.Items) != 4 {
+		t.Errorf("raw:%v err:%v", raw.Items, err)
+	}
+
+	if _, err = Unmarshal(data[:len(data)-1], &out); err == nil {
+		t.Errorf("truncated item should fail")
+	}
+	data[8] = 0x03
+	if _, err = Unmarshal(data[:12], &out); err == nil {
+		t.Errorf("short known item should fail")
+	}
+
+	//已知项长度超过字段所需时保留完整的原始数据
+	long := []byte{0x00, 0x00, 0x00, 0x01, 0x01, 0x06, 0x00, 0x00, 0x01, 0x00, 0xCC, 0xDD}
+	var longOut Body
+	if _, err = Unmarshal(long, &longOut); err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if longOut.Extra.Mileage == nil || *longOut.Extra.Mileage != 256 || !bytes.Equal(longOut.Extra.Other[0x01], long[6:]) {
+		t.Errorf("long extra:%+v", longOut.Extra)
+	}
+	if repack, err = Marshal(&longOut); err != nil || !bytes.Equal(repack, long) {
+		t.Errorf("long repack:%x err:%v", repack, err)
+	}
+}
+
+func TestNumber(t *testing.T) {
+	type Body struct {
+		I8  int8
+		I16 int16
+		I32 int32
+		I64 int64
+		U64 uint64
+		F32 float32
+		F64 float64
+		On  bool
+	}
+
+	pack := Body{I8: -2, I16: -300, I32: -70000, I64: -1 << 40, U64: 0x0102030405060708, F32: 1.5, F64: -2.25, On: true}
+	data, err := Marshal(&pack)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+
+	want := []byte{0xFE, 0xFE, 0xD4, 0xFF, 0xFE, 0xEE, 0x90,
+		0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x3F, 0xC0, 0x00, 0x00,
+		0xC0, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("data:%x", data)
+	}
+
+	var out Body
+	used, err := Unmarshal(data, &out)
+	if err != nil || used != len(data) || out != pack {
+		t.Errorf("used:%d out:%+v err:%v", used, out, err)
+	}
+
+	var one struct {
+		A uint8
+		B uint8
+	}
+	if _, err = refUnmarshal([]byte{0x01}, reflect.ValueOf(&one), noTag, 0, binary.BigEndian); err == nil {
+		t.Errorf("short uint8 should fail")
+	}
+}
+
+//FuzzUnmarshal checks that Unmarshal never panics on arbitrary input
+func FuzzUnmarshal(f *testing.F) {
+	type Item struct {
+		ID   uint16
+		Data []byte `prefix:"u8"`
+	}
+	type Extra struct {
+		Mileage *uint32          `tlvid:"0x01"`
+		Name    *string          `tlvid:"0x02"`
+		Other   map[uint8][]byte `tlvid:"*"`
+	}
+	type Point struct {
+		Lat   uint32
+		Time  time.Time
+		Extra Extra `tlv:"u8,u8"`
+	}
+	type Body struct {
+		On     bool
+		F      float64
+		KeyLen uint8
+		Key    string `lenfield:"KeyLen"`
+		Phone  string `len:"6" enc:"bcd"`
+		Name   string `zeroend:"true" enc:"gbk"`
+		Count  int8
+		Items  []Item `countfield:"Count"`
+		Points []struct {
+			Info Point `prefix:"u16"`
+		}
+	}
+
+	f.Add([]byte{})
+	f.Add([]byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x02, 'a', 'b', 0x01, 0x38, 0x00, 0x12, 0x34, 0x56, 'x', 0x00,
+		0x01, 0x00, 0x01, 0x01, 0xAA,
+		0x00, 0x0F, 0x00, 0x00, 0x00, 0x01, 0x20, 0x01, 0x02, 0x03, 0x04, 0x05, 0x01, 0x01, 0x02, 0xE1, 0x00})
+	f.Add([]byte{0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var body Body
+		Unmarshal(data, &body)
+		var point Point
+		Unmarshal(data, &point)
+	})
+}
+
+//gpsInfoBody is a copy of term.GPSInfoBody, term imports codec
+type gpsInfoBody struct {
+	WarnFlag struct {
+		Emergency bool   `bit:"0"`
+		Overspeed bool   `bit:"1"`
+		Raw       uint32 `bits:"all"`
+	} `bitfield:"u32"`
+	State struct {
+		ACC   bool   `bit:"0"`
+		Fixed bool   `bit:"1"`
+		Load  uint8  `bits:"8-9"`
+		Raw   uint32 `bits:"all"`
+	} `bitfield:"u32"`
+	Lat   uint32
+	Lng   uint32
+	Alt   uint16
+	Speed uint16
+	Dir   uint16
+	Time  BCDTime
+	Extra struct {
+		Mileage   *uint32          `tlvid:"0x01"`
+		Fuel      *uint16          `tlvid:"0x02"`
+		Speed     *uint16          `tlvid:"0x03"`
+		AlarmID   *uint16          `tlvid:"0x04"`
+		Signal    *uint8           `tlvid:"0x30"`
+		Satellite *uint8           `tlvid:"0x31"`
+		Other     map[uint8][]byte `tlvid:"*"`
+	} `tlv:"u8,u8"`
+}
+
+var gpsInfoData = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x00, 0x03,
+	0x01, 0x58, 0x9A, 0x10, 0x06, 0xC8, 0x2B, 0x90,
+	0x00, 0x32, 0x02, 0x58, 0x00, 0x5A,
+	0x20, 0x10, 0x18, 0x10, 0x30, 0x00,
+	0x01, 0x04, 0x00, 0x00, 0x30, 0x39,
+	0x30, 0x01, 0x1F,
+	0x31, 0x01, 0x0C}
+
+func BenchmarkUnmarshalGPS(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var body gpsInfoBody
+		if _, err := Unmarshal(gpsInfoData, &body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalGPS(b *testing.B) {
+	var body gpsInfoBody
+	if _, err := Unmarshal(gpsInfoData, &body); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(&body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//hexWord decode itself from a 4 char hex string
+type hexWord uint16
+
+func (w hexWord) MarshalJT808() ([]byte, error) {
+	return []byte(fmt.Sprintf("%04X", uint16(w))), nil
+}
+
+func (w *hexWord) UnmarshalJT808(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, fmt.Errorf("data to short")
+	}
+	n, err := strconv.ParseUint(string(data[:4]), 16, 16)
+	if err != nil {
+		return 0, err
+	}
+	*w = hexWord(n)
+	return 4, nil
+}
+
+func (w hexWord) SizeJT808() int {
+	return 4
+}
+
+func TestCustom(t *testing.T) {
+	type Body struct {
+		Stamp BCDTime
+		Word  hexWord
+		Count uint8
+		Words []hexWord `countfield:"Count"`
+		Tail  *hexWord  `prefix:"u8"`
+	}
+
+	tail := hexWord(0xBEEF)
+	pack := Body{
+		Stamp: BCDTime{time.Date(2020, 10, 18, 10, 30, 0, 0, CST)},
+		Word:  0x1234,
+		Words: []hexWord{0xA, 0xB},
+		Tail:  &tail,
+	}
+	length, err := RequireLen(&pack)
+	if err != nil || length != 6+4+1+1 {
+		t.Errorf("require len:%d err:%v", length, err)
+	}
+
+	data, err := Marshal(&pack)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	want := []byte{0x20, 0x10, 0x18, 0x10, 0x30, 0x00, '1', '2', '3', '4',
+		0x02, '0', '0', '0', 'A', '0', '0', '0', 'B',
+		0x04, 'B', 'E', 'E', 'F'}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("data:%x", data)
+	}
+
+	var out Body
+	used, err := Unmarshal(data, &out)
+	if err != nil || used != len(data) {
+		t.Fatalf("used:%d err:%v", used, err)
+	}
+	if !out.Stamp.Equal(pack.Stamp.Time) || out.Word != 0x1234 || len(out.Words) != 2 || out.Words[1] != 0xB ||
+		out.Tail == nil || *out.Tail != 0xBEEF {
+		t.Errorf("out:%+v", out)
+	}
+
+	data[6] = 'X'
+	if _, err = Unmarshal(data, &out); err == nil {
+		t.Errorf("bad custom field should fail")
+	}
+}
+
+func TestBits(t *testing.T) {
+	type Status struct {
+		ACC   bool   `bit:"0"`
+		Fixed bool   `bit:"1"`
+		Load  uint8  `bits:"8-9"`
+		Door  bool   `bit:"31"`
+		Raw   uint32 `bits:"all"`
+	}
+	type Body struct {
+		State Status `bitfield:"u32"`
+		Flags struct {
+			Low  uint8 `bits:"0-3"`
+			High uint8 `bits:"4-7"`
+		} `bitfield:"u8"`
+	}
+
+	data := []byte{0x80, 0x10, 0x03, 0x01, 0xA5}
+	var out Body
+	used, err := Unmarshal(data, &out)
+	if err != nil || used != 5 {
+		t.Fatalf("used:%d err:%v", used, err)
+	}
+	if !out.State.ACC || out.State.Fixed || out.State.Load != 3 || !out.State.Door || out.State.Raw != 0x80100301 {
+		t.Errorf("state:%+v", out.State)
+	}
+	if out.Flags.Low != 0x5 || out.Flags.High != 0xA {
+		t.Errorf("flags:%+v", out.Flags)
+	}
+
+	//命名位按字段编码，bit 20等未命名的位从Raw保留
+	out.State.ACC = false
+	out.State.Fixed = true
+	out.State.Load = 1
+	repack, err := Marshal(&out)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if !bytes.Equal(repack, []byte{0x80, 0x10, 0x01, 0x02, 0xA5}) {
+		t.Errorf("repack:%x", repack)
+	}
+
+	if _, err = Unmarshal(data[:3], &out); err == nil {
+		t.Errorf("short bitfield should fail")
+	}
+}
+
+func TestOrder(t *testing.T) {
+	type Body struct {
+		A    uint16
+		B    uint32 `order:"be"`
+		Name string `prefix:"u16"`
+		C    int16  `order:"le"`
+	}
+
+	pack := Body{A: 0x0102, B: 0x03040506, Name: "ab", C: -2}
+	data, err := MarshalOrder(&pack, binary.LittleEndian)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	want := []byte{0x02, 0x01, 0x03, 0x04, 0x05, 0x06, 0x02, 0x00, 'a', 'b', 0xFE, 0xFF}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("data:%x", data)
+	}
+
+	var out Body
+	used, err := UnmarshalOrder(data, &out, binary.LittleEndian)
+	if err != nil || used != len(data) || out != pack {
+		t.Errorf("used:%d out:%+v err:%v", used, out, err)
+	}
+
+	//默认大端，order标签的字段仍按标签
+	data, err = Marshal(&pack)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	want = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x00, 0x02, 'a', 'b', 0xFE, 0xFF}
+	if !bytes.Equal(data, want) {
+		t.Errorf("data:%x", data)
+	}
+}
+
+func TestDump(t *testing.T) {
+	type Item struct {
+		ID   uint16
+		Name string `prefix:"u8"`
+	}
+	type Body struct {
+		Count uint8
+		Items []Item `countfield:"Count"`
+		gpsInfoBody
+	}
+
+	data := append([]byte{0x02, 0x00, 0x01, 0x01, 'a', 0x00, 0x02, 0x00}, gpsInfoData...)
+	var body Body
+	fields, err := Dump(data, &body)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if len(fields) != 3 || fields[1].Name != "Items" || len(fields[1].Fields) != 2 {
+		t.Fatalf("fields:%+v", fields)
+	}
+
+	item := fields[1].Fields[1]
+	if item.Offset != 5 || item.Len != 3 || item.Fields[0].Value != uint16(2) || item.Fields[1].Value != "" {
+		t.Errorf("item:%+v", item)
+	}
+
+	gps := fields[2].Fields
+	if gps[2].Name != "Lat" || gps[2].Offset != 16 || gps[2].Value != uint32(0x01589A10) {
+		t.Errorf("lat:%+v", gps[2])
+	}
+	extra := gps[len(gps)-1]
+	if extra.Offset != 36 || len(extra.Fields) != 3 || extra.Fields[0].Name != "Mileage(0x01)" || extra.Fields[0].Value != uint32(12345) {
+		t.Errorf("extra:%+v", extra)
+	}
+	if state := gps[1].Fields; state[0].Name != "ACC(bit 0)" || state[0].Value != true || state[2].Value != uint8(0) {
+		t.Errorf("state:%+v", state)
+	}
+
+	t.Log("\n" + FormatDump(fields))
+}
@@ -0,0 +1,245 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+//Field is one field of a Dump, Offset和Len为字段在数据中的位置
+type Field struct {
+	Name   string
+	Offset int
+	Len    int
+	Raw    []byte
+	Value  interface{}
+	Fields []Field
+}
+
+//Dump decode data into v like Unmarshal and return where every field is
+func Dump(data []byte, v interface{}) ([]Field, error) {
+	return DumpOrder(data, v, binary.BigEndian)
+}
+
+//DumpOrder is Dump with the byte order of integers
+func DumpOrder(data []byte, v interface{}, order binary.ByteOrder) ([]Field, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("error")
+	}
+
+	lens, err := RequireLen(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < lens {
+		return nil, fmt.Errorf("data too short,datalen:%d,lens:%d", len(data), lens)
+	}
+
+	fields, _, err := dumpStruct(data, rv.Elem(), len(data)-lens, order, 0)
+	return fields, err
+}
+
+//dumpStruct decode the fields of struct v and record them, base为data在整个数据中的偏移
+func dumpStruct(data []byte, v reflect.Value, streLen int, order binary.ByteOrder, base int) ([]Field, int, error) {
+	plan, err := getPlan(v.Type())
+	if err != nil {
+		return nil, 0, err
+	}
+	total := plan.restLen[0] + streLen
+
+	fields := make([]Field, 0, len(plan.fields))
+	usedLen := 0
+	for i, field := range plan.fields {
+		fieldLen := total - usedLen - plan.restLen[i]
+		if field.tag.lenField >= 0 {
+			fieldLen = intValue(v.Field(field.tag.lenField))
+		}
+
+		fv := v.Field(i)
+		var children []Field
+		var l int
+		if field.tag.countField >= 0 {
+			n := intValue(v.Field(field.tag.countField))
+			children, l, err = dumpList(data[usedLen:], fv, n, fieldLen, order, base+usedLen)
+		} else {
+			children, l, err = dumpValue(data[usedLen:], fv, field.tag, fieldLen, order, base+usedLen)
+		}
+		if err != nil {
+			return fields, 0, fmt.Errorf("%s:%s", field.tag.name, err.Error())
+		}
+
+		fields = append(fields, newField(field.tag.name, base+usedLen, data[usedLen:usedLen+l], fv, children))
+		usedLen = usedLen + l
+	}
+	return fields, usedLen, nil
+}
+
+//dumpValue decode one value like refUnmarshal, and record the fields inside it
+func dumpValue(data []byte, v reflect.Value, tag *fieldTag, streLen int, order binary.ByteOrder, base int) ([]Field, int, error) {
+	order = tag.byteOrder(order)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	custom := typeKind(v, tag).unmarshal || v.Type() == timeType
+
+	switch {
+	case custom:
+	case isList(v.Type()):
+		return dumpList(data, v, -1, streLen, order, base)
+	case tag.tlv != nil:
+		l, err := refUnmarshal(data, v, tag, streLen, order)
+		if err != nil {
+			return nil, 0, err
+		}
+		children, err := dumpTLV(data[:l], v, tag, order, base)
+		return children, l, err
+	case tag.bitfield > 0:
+		l, err := refUnmarshal(data, v, tag, streLen, order)
+		if err != nil {
+			return nil, 0, err
+		}
+		return dumpBits(data[:l], v, base), l, nil
+	case v.Kind() == reflect.Struct && tag.prefix > 0:
+		raw, l, err := fieldBytes(data, tag, streLen, order)
+		if err != nil {
+			return nil, 0, err
+		}
+		inner, err := typeRequireLen(v.Type(), noTag)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(raw) < inner {
+			return nil, 0, fmt.Errorf("data to short,%s:%d", tag.name, len(raw))
+		}
+		children, _, err := dumpStruct(raw, v, len(raw)-inner, order, base+tag.prefix)
+		return children, l, err
+	case v.Kind() == reflect.Struct:
+		return dumpStruct(data, v, streLen, order, base)
+	}
+
+	l, err := refUnmarshal(data, v, tag, streLen, order)
+	return nil, l, err
+}
+
+//dumpList decode a list like refUnmarshalList, every item is a Field named [i]
+func dumpList(data []byte, v reflect.Value, count int, budget int, order binary.ByteOrder, base int) ([]Field, int, error) {
+	l, err := refUnmarshalList(data, v, count, budget, order)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	items := make([]Field, 0, v.Len())
+	usedLen := 0
+	for i := 0; i < v.Len(); i++ {
+		item := reflect.New(v.Type().Elem()).Elem()
+		itemLen, err := typeRequireLen(item.Type(), noTag)
+		if err != nil {
+			return nil, 0, err
+		}
+		children, n, err := dumpValue(data[usedLen:l], item, noTag, l-usedLen-itemLen, order, base+usedLen)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		items = append(items, newField(fmt.Sprintf("[%d]", i), base+usedLen, data[usedLen:usedLen+n], v.Index(i), children))
+		usedLen = usedLen + n
+	}
+	return items, l, nil
+}
+
+//dumpTLV record every tlv item of a decoded tlv field
+func dumpTLV(data []byte, v reflect.Value, tag *fieldTag, order binary.ByteOrder, base int) ([]Field, error) {
+	var plan *structPlan
+	if v.Kind() == reflect.Struct {
+		var err error
+		if plan, err = getPlan(v.Type()); err != nil {
+			return nil, err
+		}
+	}
+
+	items := make([]Field, 0)
+	for rest := data; len(rest) > 0; {
+		offset := len(data) - len(rest)
+		item, next, err := nextTLV(rest, tag.tlv, order)
+		if err != nil {
+			return nil, err
+		}
+		n := len(rest) - len(next)
+		rest = next
+
+		name := fmt.Sprintf("0x%02X", item.id)
+		var value reflect.Value
+		if plan != nil {
+			if i, ok := plan.tlvIndex[item.id]; ok {
+				name = fmt.Sprintf("%s(0x%02X)", plan.fields[i].tag.name, item.id)
+				value = v.Field(i)
+			}
+		}
+		if !value.IsValid() {
+			value = reflect.ValueOf(item.value)
+		}
+		items = append(items, newField(name, base+offset, data[offset:offset+n], value, nil))
+	}
+	return items, nil
+}
+
+//dumpBits record the named bits of a decoded bit-field word
+func dumpBits(data []byte, v reflect.Value, base int) []Field {
+	plan, _ := getPlan(v.Type())
+	bits := make([]Field, 0, len(plan.fields))
+	for i, field := range plan.fields {
+		if field.tag.bitLo < 0 {
+			continue
+		}
+		name := fmt.Sprintf("%s(bit %d)", field.tag.name, field.tag.bitLo)
+		if field.tag.bitHi > field.tag.bitLo {
+			name = fmt.Sprintf("%s(bit %d-%d)", field.tag.name, field.tag.bitLo, field.tag.bitHi)
+		}
+		bits = append(bits, newField(name, base, data, v.Field(i), nil))
+	}
+	return bits
+}
+
+func newField(name string, offset int, raw []byte, v reflect.Value, children []Field) Field {
+	field := Field{Name: name, Offset: offset, Len: len(raw), Raw: raw, Fields: children}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return field
+		}
+		v = v.Elem()
+	}
+	if children == nil && v.CanInterface() {
+		field.Value = v.Interface()
+	}
+	return field
+}
+
+//FormatDump format the fields of Dump as an indented tree
+func FormatDump(fields []Field) string {
+	var b strings.Builder
+	formatFields(&b, fields, 0)
+	return b.String()
+}
+
+func formatFields(b *strings.Builder, fields []Field, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, f := range fields {
+		fmt.Fprintf(b, "%s%-*s %4d %4d  % X", indent, 28-len(indent), f.Name, f.Offset, f.Len, f.Raw)
+		if f.Value != nil {
+			switch value := f.Value.(type) {
+			case []byte:
+			case string:
+				fmt.Fprintf(b, "  %q", value)
+			default:
+				fmt.Fprintf(b, "  %v", value)
+			}
+		}
+		b.WriteString("\n")
+		formatFields(b, f.Fields, depth+1)
+	}
+}
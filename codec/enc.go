@@ -0,0 +1,68 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+//string字段的enc标签取值
+const (
+	EncBCD = "bcd"
+	EncGBK = "gbk"
+)
+
+//decodeString decode the raw data of a string field by enc tag
+func decodeString(data []byte, enc string) (string, error) {
+	switch enc {
+	case "":
+		return string(data), nil
+	case EncBCD:
+		return BCD2String(data)
+	case EncGBK:
+		//定长字段不足时后补0x00
+		data = bytes.TrimRight(data, "\x00")
+		str, err := simplifiedchinese.GBK.NewDecoder().Bytes(data)
+		if err != nil {
+			return "", err
+		}
+		return string(str), nil
+	}
+	return "", fmt.Errorf("unknown enc:%s", enc)
+}
+
+//encodeString encode a string field by enc tag, lens为len标签的值，没有len标签时为-1
+func encodeString(s string, enc string, lens int) ([]byte, error) {
+	switch enc {
+	case "":
+		data := []byte(s)
+		if lens < 0 {
+			return data, nil
+		}
+		if len(data) > lens {
+			return data[:lens], nil
+		}
+		//前补0x00
+		return append(make([]byte, lens-len(data)), data...), nil
+	case EncBCD:
+		if lens < 0 {
+			lens = (len(s) + 1) / 2
+		}
+		return String2BCD(s, lens)
+	case EncGBK:
+		data, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(s))
+		if err != nil {
+			return []byte{}, err
+		}
+		if lens < 0 {
+			return data, nil
+		}
+		if len(data) > lens {
+			return []byte{}, fmt.Errorf("%s is longer than %d bytes", s, lens)
+		}
+		//后补0x00
+		return append(data, make([]byte, lens-len(data))...), nil
+	}
+	return []byte{}, fmt.Errorf("unknown enc:%s", enc)
+}
@@ -0,0 +1,71 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+//isList report whether t is a slice of items other than bytes
+func isList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8
+}
+
+//refUnmarshalList decode count items into the slice v,
+//count小于0时按字节数budget解析到数据结束
+func refUnmarshalList(data []byte, v reflect.Value, count int, budget int, order binary.ByteOrder) (int, error) {
+	elemType := v.Type().Elem()
+	itemLen, err := typeRequireLen(elemType, noTag)
+	if err != nil {
+		return 0, err
+	}
+	if count < 0 && budget > len(data) {
+		return 0, fmt.Errorf("data to short")
+	}
+
+	capacity := count
+	if count < 0 || (itemLen > 0 && count > len(data)/itemLen) {
+		capacity = 0
+	}
+	list := reflect.MakeSlice(v.Type(), 0, capacity)
+	usedLen := 0
+	for i := 0; count < 0 || i < count; i++ {
+		if count < 0 && usedLen >= budget {
+			break
+		}
+		if len(data)-usedLen < itemLen {
+			return 0, fmt.Errorf("data to short,item %d", i)
+		}
+
+		rest := len(data) - usedLen - itemLen
+		if count < 0 {
+			rest = budget - usedLen - itemLen
+		}
+		list = reflect.Append(list, reflect.Zero(elemType))
+		l, err := refUnmarshal(data[usedLen:], list.Index(i), noTag, rest, order)
+		if err != nil {
+			return 0, err
+		}
+		//防止空元素导致死循环
+		if l == 0 {
+			return 0, fmt.Errorf("empty list item %s", elemType)
+		}
+
+		usedLen = usedLen + l
+	}
+
+	v.Set(list)
+	return usedLen, nil
+}
+
+//refMarshalList append every item of the slice v to data
+func refMarshalList(data []byte, v reflect.Value, order binary.ByteOrder) ([]byte, error) {
+	var err error
+	for i := 0; i < v.Len(); i++ {
+		data, err = refMarshal(data, v.Index(i), noTag, order)
+		if err != nil {
+			return data, err
+		}
+	}
+	return data, nil
+}
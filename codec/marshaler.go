@@ -0,0 +1,97 @@
+package codec
+
+import (
+	"reflect"
+	"sync"
+)
+
+//Marshaler is implemented by field types that encode themselves
+type Marshaler interface {
+	MarshalJT808() ([]byte, error)
+}
+
+//Unmarshaler is implemented by field types that decode themselves,
+//UnmarshalJT808返回使用的字节数
+type Unmarshaler interface {
+	UnmarshalJT808(data []byte) (int, error)
+}
+
+//Sizer report the least encoded length of a custom type for RequireLen,
+//没有实现Sizer的自定义类型按变长处理
+type Sizer interface {
+	SizeJT808() int
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	sizerType       = reflect.TypeOf((*Sizer)(nil)).Elem()
+)
+
+//customKind records which interfaces a type implements
+type customKind struct {
+	marshal   bool
+	marshalP  bool //*T实现了Marshaler
+	unmarshal bool //*T实现了Unmarshaler
+}
+
+//customKinds cache the customKind of every type seen by reflect.Type
+var customKinds sync.Map
+
+func getCustomKind(t reflect.Type) customKind {
+	if kind, ok := customKinds.Load(t); ok {
+		return kind.(customKind)
+	}
+
+	pt := reflect.PtrTo(t)
+	kind := customKind{
+		marshal:   t.Implements(marshalerType),
+		marshalP:  pt.Implements(marshalerType),
+		unmarshal: pt.Implements(unmarshalerType),
+	}
+	customKinds.Store(t, kind)
+	return kind
+}
+
+//isCustom report whether t or *t implements Marshaler or Unmarshaler
+func isCustom(t reflect.Type) bool {
+	kind := getCustomKind(t)
+	return kind.marshal || kind.marshalP || kind.unmarshal
+}
+
+//customSize return the Sizer length of a custom type
+func customSize(t reflect.Type) int {
+	if t.Implements(sizerType) {
+		return reflect.Zero(t).Interface().(Sizer).SizeJT808()
+	}
+	if reflect.PtrTo(t).Implements(sizerType) {
+		return reflect.New(t).Interface().(Sizer).SizeJT808()
+	}
+	return 0
+}
+
+//typeKind return the customKind of v, from the field tag when it has one
+func typeKind(v reflect.Value, tag *fieldTag) customKind {
+	if tag.custom != nil {
+		return *tag.custom
+	}
+	return getCustomKind(v.Type())
+}
+
+func asMarshaler(v reflect.Value, tag *fieldTag) (Marshaler, bool) {
+	kind := typeKind(v, tag)
+	if kind.marshal {
+		return v.Interface().(Marshaler), true
+	}
+	if kind.marshalP && v.CanAddr() {
+		return v.Addr().Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+func asUnmarshaler(v reflect.Value, tag *fieldTag) (Unmarshaler, bool) {
+	if typeKind(v, tag).unmarshal && v.CanAddr() {
+		return v.Addr().Interface().(Unmarshaler), true
+	}
+	return nil, false
+}
@@ -0,0 +1,227 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+//fieldTag is the parsed struct tag of one field
+type fieldTag struct {
+	name       string
+	fixed      int         //len标签，-1表示没有
+	prefix     int         //长度前缀的字节数，0表示没有
+	zeroend    bool        //以0x00结束
+	enc        string      //string字段的编码
+	lenField   int         //lenfield指向的字段序号，-1表示没有
+	countField int         //countfield指向的字段序号，-1表示没有
+	tlv        *tlvFormat  //tlv字段的格式
+	tlvID      string      //tlvid标签
+	custom     *customKind //字段类型实现的接口
+	bitfield   int         //位域字的字节数，0表示不是位域
+	bitLo      int         //位域结构体中字段占用的位，-1表示没有
+	bitHi      int
+	bitAll     bool             //保存整个原始字
+	order      binary.ByteOrder //order标签给出的字节序，nil表示沿用上层
+}
+
+//byteOrder return the byte order of the field, order if the field has no order tag
+func (tag *fieldTag) byteOrder(order binary.ByteOrder) binary.ByteOrder {
+	if tag.order != nil {
+		return tag.order
+	}
+	return order
+}
+
+//order标签取值
+const (
+	OrderBE = "be"
+	OrderLE = "le"
+)
+
+//noTag is used for the top value and list items which have no struct tag
+var noTag = &fieldTag{fixed: -1, lenField: -1, countField: -1, bitLo: -1, bitHi: -1}
+
+type fieldPlan struct {
+	typ reflect.Type
+	tag *fieldTag
+}
+
+//structPlan is the compiled encoding plan of a struct type
+type structPlan struct {
+	fields []fieldPlan
+	//restLen[i]为第i个及之后字段的最小长度，用来计算变长字段可用的长度
+	restLen []int
+	//tlv结构体中按tlvid索引的字段序号，tlvRaw为tlvid:"*"的字段序号
+	tlvIndex map[uint64]int
+	tlvRaw   int
+	//位域结构体中有名字段占用的位
+	bitMask uint64
+}
+
+//plans cache the structPlan of every struct type by reflect.Type
+var plans sync.Map
+
+type planEntry struct {
+	plan *structPlan
+	err  error
+}
+
+//getPlan return the cached plan of a struct type, compile it at the first use
+func getPlan(t reflect.Type) (*structPlan, error) {
+	if entry, ok := plans.Load(t); ok {
+		e := entry.(planEntry)
+		return e.plan, e.err
+	}
+
+	plan, err := compilePlan(t)
+	plans.Store(t, planEntry{plan: plan, err: err})
+	return plan, err
+}
+
+func compilePlan(t reflect.Type) (*structPlan, error) {
+	fieldCount := t.NumField()
+	plan := &structPlan{
+		fields:   make([]fieldPlan, fieldCount),
+		restLen:  make([]int, fieldCount+1),
+		tlvIndex: make(map[uint64]int),
+		tlvRaw:   -1,
+	}
+
+	for i := 0; i < fieldCount; i++ {
+		field := t.Field(i)
+		tag, err := parseTag(t, field)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s:%s", t.Name(), field.Name, err.Error())
+		}
+		plan.fields[i] = fieldPlan{typ: field.Type, tag: tag}
+
+		switch tag.tlvID {
+		case "":
+		case "*":
+			plan.tlvRaw = i
+		default:
+			id, err := strconv.ParseUint(tag.tlvID, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s:%s", t.Name(), field.Name, err.Error())
+			}
+			plan.tlvIndex[id] = i
+		}
+
+		if tag.bitLo >= 0 {
+			plan.bitMask |= bitMask(tag.bitLo, tag.bitHi)
+		}
+	}
+
+	for i := fieldCount - 1; i >= 0; i-- {
+		l, err := typeRequireLen(plan.fields[i].typ, plan.fields[i].tag)
+		if err != nil {
+			return nil, err
+		}
+		plan.restLen[i] = plan.restLen[i+1] + l
+	}
+	return plan, nil
+}
+
+//parseTag parse the codec tags of a field of struct t
+func parseTag(t reflect.Type, field reflect.StructField) (*fieldTag, error) {
+	elemType := field.Type
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	kind := getCustomKind(elemType)
+
+	tag := &fieldTag{
+		custom:     &kind,
+		name:       field.Name,
+		fixed:      -1,
+		zeroend:    field.Tag.Get("zeroend") == "true",
+		enc:        field.Tag.Get("enc"),
+		lenField:   -1,
+		countField: -1,
+		tlvID:      field.Tag.Get("tlvid"),
+		bitLo:      -1,
+		bitHi:      -1,
+	}
+
+	if str := field.Tag.Get("len"); str != "" {
+		lens, err := strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		tag.fixed = int(lens)
+	}
+
+	if str := field.Tag.Get("prefix"); str != "" {
+		size, err := prefixSize(str)
+		if err != nil {
+			return nil, err
+		}
+		tag.prefix = size
+	}
+
+	if str := field.Tag.Get("tlv"); str != "" {
+		format, err := parseTLV(str)
+		if err != nil {
+			return nil, err
+		}
+		tag.tlv = &format
+	}
+
+	switch str := field.Tag.Get("order"); str {
+	case "":
+	case OrderBE:
+		tag.order = binary.BigEndian
+	case OrderLE:
+		tag.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("unknown order:%s", str)
+	}
+
+	if str := field.Tag.Get("bitfield"); str != "" {
+		size, err := prefixSize(str)
+		if err != nil {
+			return nil, err
+		}
+		tag.bitfield = size
+	}
+	if err := parseBits(tag, field); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if tag.lenField, err = siblingIndex(t, field.Tag.Get("lenfield")); err != nil {
+		return nil, err
+	}
+	if tag.countField, err = siblingIndex(t, field.Tag.Get("countfield")); err != nil {
+		return nil, err
+	}
+
+	switch tag.enc {
+	case "", EncBCD, EncGBK:
+	default:
+		return nil, fmt.Errorf("unknown enc:%s", tag.enc)
+	}
+	return tag, nil
+}
+
+//siblingIndex return the index of the integer field named by lenfield or countfield
+func siblingIndex(t reflect.Type, name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+
+	f, ok := t.FieldByName(name)
+	if !ok || len(f.Index) != 1 {
+		return -1, fmt.Errorf("field %s not found", name)
+	}
+	switch f.Type.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		return -1, fmt.Errorf("field %s is not an integer", name)
+	}
+	return f.Index[0], nil
+}
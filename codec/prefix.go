@@ -0,0 +1,128 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+//prefix标签取值，表示变长字段前面长度字段的类型
+const (
+	PrefixU8  = "u8"
+	PrefixU16 = "u16"
+	PrefixU32 = "u32"
+)
+
+//prefixSize return the byte size of a length prefix
+func prefixSize(prefix string) (int, error) {
+	switch prefix {
+	case PrefixU8:
+		return 1, nil
+	case PrefixU16:
+		return 2, nil
+	case PrefixU32:
+		return 4, nil
+	}
+	return 0, fmt.Errorf("unknown prefix:%s", prefix)
+}
+
+//varRequireLen return the least length of a string or slice field
+func varRequireLen(tag *fieldTag) int {
+	if tag.fixed >= 0 {
+		return tag.fixed
+	}
+	if tag.prefix > 0 {
+		return tag.prefix
+	}
+	if tag.zeroend {
+		return 1
+	}
+	return 0
+}
+
+//fieldBytes pick the content of a string or slice field from data.
+//按len标签、prefix长度前缀、zeroend结束符的顺序确定长度，都没有时使用streLen
+func fieldBytes(data []byte, tag *fieldTag, streLen int, order binary.ByteOrder) ([]byte, int, error) {
+	if tag.fixed >= 0 {
+		if len(data) < tag.fixed {
+			return nil, 0, fmt.Errorf("data to short")
+		}
+		return data[:tag.fixed], tag.fixed, nil
+	}
+
+	if tag.prefix > 0 {
+		size := tag.prefix
+		if len(data) < size {
+			return nil, 0, fmt.Errorf("data to short")
+		}
+		n := int(readUint(data, size, order))
+		if n < 0 || len(data)-size < n {
+			return nil, 0, fmt.Errorf("data to short,%s:%d", tag.name, n)
+		}
+		return data[size : size+n], size + n, nil
+	}
+
+	if tag.zeroend {
+		idx := bytes.IndexByte(data, 0)
+		if idx < 0 {
+			return nil, 0, fmt.Errorf("%s is not zero terminated", tag.name)
+		}
+		return data[:idx], idx + 1, nil
+	}
+
+	if streLen < 0 || len(data) < streLen {
+		return nil, 0, fmt.Errorf("data to short")
+	}
+	return data[:streLen], streLen, nil
+}
+
+//wrapField append an encoded field to data with its length prefix or zero terminator
+func wrapField(data []byte, content []byte, tag *fieldTag, order binary.ByteOrder) ([]byte, error) {
+	if tag.fixed >= 0 {
+		return append(data, content...), nil
+	}
+
+	if tag.prefix > 0 {
+		if tag.prefix < 4 && len(content) >= 1<<(8*uint(tag.prefix)) {
+			return data, fmt.Errorf("%s is too long for %d bytes prefix", tag.name, tag.prefix)
+		}
+		data = appendUint(data, uint64(len(content)), tag.prefix, order)
+		return append(data, content...), nil
+	}
+
+	if tag.zeroend {
+		data = append(data, content...)
+		return append(data, 0), nil
+	}
+	return append(data, content...), nil
+}
+
+//patchPrefix fill in the length prefix written at data[start:]
+func patchPrefix(data []byte, start int, tag *fieldTag, order binary.ByteOrder) ([]byte, error) {
+	n := len(data) - start - tag.prefix
+	if tag.prefix < 4 && n >= 1<<(8*uint(tag.prefix)) {
+		return data, fmt.Errorf("%s is too long for %d bytes prefix", tag.name, tag.prefix)
+	}
+	appendUint(data[start:start], uint64(n), tag.prefix, order)
+	return data, nil
+}
+
+//intValue return the value of a lenfield or countfield field
+func intValue(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(v.Uint())
+	}
+	return int(v.Int())
+}
+
+//setLenField overwrite the encoded length field dst with n
+func setLenField(dst []byte, field fieldPlan, n int, order binary.ByteOrder) error {
+	size := len(dst)
+	if size < 8 && n >= 1<<(8*uint(size)) {
+		return fmt.Errorf("length %d overflow %s", n, field.tag.name)
+	}
+	appendUint(dst[:0], uint64(n), size, order)
+	return nil
+}
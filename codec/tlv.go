@@ -0,0 +1,185 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//tlvFormat is the size of the id and length fields of a tlv item,
+//由tlv标签给出，如tlv:"u8,u8"
+type tlvFormat struct {
+	idSize  int
+	lenSize int
+}
+
+//tlvItem is one raw tlv item
+type tlvItem struct {
+	id    uint64
+	value []byte
+}
+
+func parseTLV(tag string) (tlvFormat, error) {
+	parts := strings.Split(tag, ",")
+	if len(parts) != 2 {
+		return tlvFormat{}, fmt.Errorf("bad tlv tag:%s", tag)
+	}
+
+	idSize, err := prefixSize(parts[0])
+	if err != nil {
+		return tlvFormat{}, err
+	}
+	lenSize, err := prefixSize(parts[1])
+	if err != nil {
+		return tlvFormat{}, err
+	}
+	return tlvFormat{idSize: idSize, lenSize: lenSize}, nil
+}
+
+//nextTLV read the first tlv item of data
+func nextTLV(data []byte, format *tlvFormat, order binary.ByteOrder) (tlvItem, []byte, error) {
+	if len(data) < format.idSize+format.lenSize {
+		return tlvItem{}, nil, fmt.Errorf("data to short,tlv head")
+	}
+	id := readUint(data, format.idSize, order)
+	n := int(readUint(data[format.idSize:], format.lenSize, order))
+	data = data[format.idSize+format.lenSize:]
+	if n < 0 || len(data) < n {
+		return tlvItem{}, nil, fmt.Errorf("data to short,tlv id:0x%02x len:%d", id, n)
+	}
+	return tlvItem{id: id, value: data[:n]}, data[n:], nil
+}
+
+//refUnmarshalTLV decode the tlv items in data into v.
+//v为map时保存全部原始数据，为结构体时按tlvid标签解析，未知的项保存到tlvid:"*"的map字段，
+//已知项的长度超过字段所需时同时把完整的原始数据保存到该map字段
+func refUnmarshalTLV(data []byte, v reflect.Value, tag *fieldTag, order binary.ByteOrder) (int, error) {
+	var plan *structPlan
+	switch v.Kind() {
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+	case reflect.Struct:
+		var err error
+		plan, err = getPlan(v.Type())
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("tlv field %s must be a map or struct", tag.name)
+	}
+
+	for rest := data; len(rest) > 0; {
+		var item tlvItem
+		var err error
+		item, rest, err = nextTLV(rest, tag.tlv, order)
+		if err != nil {
+			return 0, err
+		}
+
+		if plan == nil {
+			setRawItem(v, item)
+			continue
+		}
+
+		i, ok := plan.tlvIndex[item.id]
+		if !ok {
+			setStructRaw(v, plan, item)
+			continue
+		}
+
+		field := plan.fields[i]
+		need := plan.restLen[i] - plan.restLen[i+1]
+		if len(item.value) < need {
+			return 0, fmt.Errorf("data to short,tlv id:0x%02x len:%d", item.id, len(item.value))
+		}
+		used, err := refUnmarshal(item.value, v.Field(i), field.tag, len(item.value)-need, order)
+		if err != nil {
+			return 0, err
+		}
+		if used < len(item.value) {
+			setStructRaw(v, plan, item)
+		}
+	}
+	return len(data), nil
+}
+
+//setStructRaw save a raw item to the tlvid:"*" field of struct v if it has one
+func setStructRaw(v reflect.Value, plan *structPlan, item tlvItem) {
+	if plan.tlvRaw < 0 {
+		return
+	}
+	raw := v.Field(plan.tlvRaw)
+	if raw.IsNil() {
+		raw.Set(reflect.MakeMap(raw.Type()))
+	}
+	setRawItem(raw, item)
+}
+
+func setRawItem(m reflect.Value, item tlvItem) {
+	key := reflect.ValueOf(item.id).Convert(m.Type().Key())
+	value := append([]byte{}, item.value...)
+	m.SetMapIndex(key, reflect.ValueOf(value))
+}
+
+//refMarshalTLV append v to data as tlv items sorted by id,
+//tlvid:"*"字段中与已知项ID相同的原始数据优先，该已知字段不再编码
+func refMarshalTLV(data []byte, v reflect.Value, tag *fieldTag, order binary.ByteOrder) ([]byte, error) {
+	format := tag.tlv
+	items := make([]tlvItem, 0, 8)
+	addRaw := func(m reflect.Value) {
+		iter := m.MapRange()
+		for iter.Next() {
+			items = append(items, tlvItem{id: iter.Key().Uint(), value: iter.Value().Bytes()})
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		addRaw(v)
+	case reflect.Struct:
+		plan, err := getPlan(v.Type())
+		if err != nil {
+			return data, err
+		}
+
+		var raw reflect.Value
+		if plan.tlvRaw >= 0 {
+			raw = v.Field(plan.tlvRaw)
+			addRaw(raw)
+		}
+		for id, i := range plan.tlvIndex {
+			fv := v.Field(i)
+			//nil指针表示该项不存在
+			if fv.Kind() == reflect.Ptr && fv.IsNil() {
+				continue
+			}
+			if raw.IsValid() && raw.Len() > 0 && raw.MapIndex(reflect.ValueOf(id).Convert(raw.Type().Key())).IsValid() {
+				continue
+			}
+
+			value, err := refMarshal(nil, fv, plan.fields[i].tag, order)
+			if err != nil {
+				return data, err
+			}
+			items = append(items, tlvItem{id: id, value: value})
+		}
+	default:
+		return data, fmt.Errorf("tlv field %s must be a map or struct", tag.name)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].id < items[j].id
+	})
+
+	for _, item := range items {
+		if format.lenSize < 4 && len(item.value) >= 1<<(8*uint(format.lenSize)) {
+			return data, fmt.Errorf("tlv id:0x%02x is too long", item.id)
+		}
+		data = appendUint(data, item.id, format.idSize, order)
+		data = appendUint(data, uint64(len(item.value)), format.lenSize, order)
+		data = append(data, item.value...)
+	}
+	return data, nil
+}
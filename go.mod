@@ -10,4 +10,5 @@ require (
 	github.com/go-xorm/xorm v0.7.9
 	github.com/lib/pq v1.2.0
 	github.com/sirupsen/logrus v1.2.0
+	golang.org/x/text v0.3.2
 )
@@ -0,0 +1,163 @@
+package proto
+
+import (
+	"time"
+	"tsp/codec"
+)
+
+const (
+	//AssembleTimeout is the default wait time for the rest sub packets
+	AssembleTimeout time.Duration = 10 * time.Second
+	//AssembleRetry is the default times of retransmission request before drop
+	AssembleRetry int = 3
+	//AssembleMaxSum is the max sub packet count of a message, 分包总数由终端决定，限制以免占用过多内存
+	AssembleMaxSum uint16 = 1024
+	//AssembleMaxGroups is the max count of messages being assembled at the same time
+	AssembleMaxGroups int = 8
+)
+
+type assembleKey struct {
+	mid    uint16
+	seqNum uint16
+}
+
+type assembleGroup struct {
+	header Header
+	parts  [][]byte
+	recv   int
+	stamp  time.Time
+	retry  int
+}
+
+//Lost is a multi packet message which is missing some sub packets
+type Lost struct {
+	MID     uint16
+	Attr    uint16
+	SeqNum  uint16
+	Missing []uint16
+}
+
+//Assembler is a buffer for reassembling multi packet messages
+//分包以MID和第一包的流水号为键缓存，收齐后合并为一个完整的消息
+type Assembler struct {
+	Timeout  time.Duration
+	MaxRetry int
+	groups   map[assembleKey]*assembleGroup
+}
+
+//NewAssembler create a Assembler
+func NewAssembler(timeout time.Duration, maxRetry int) *Assembler {
+	return &Assembler{
+		Timeout:  timeout,
+		MaxRetry: maxRetry,
+		groups:   make(map[assembleKey]*assembleGroup),
+	}
+}
+
+//Push add a sub packet to the buffer, it will return the complete message and true when all sub packets are received
+//分包序号错误时返回ErrBadMulti，同时组包的消息过多时返回ErrAssembleFull
+func (a *Assembler) Push(msg Message) (Message, bool, error) {
+	if !msg.HEADER.IsMulti() {
+		return msg, true, nil
+	}
+
+	sum := msg.HEADER.MutilFlag.MsgSum
+	index := msg.HEADER.MutilFlag.MsgIndex
+	if sum == 0 || index == 0 || index > sum || sum > AssembleMaxSum {
+		return Message{}, false, ErrBadMulti
+	}
+
+	//分包序号从1开始，流水号连续递增
+	key := assembleKey{
+		mid:    msg.HEADER.MID,
+		seqNum: msg.HEADER.SeqNum - (index - 1),
+	}
+
+	group, ok := a.groups[key]
+	if !ok && len(a.groups) >= AssembleMaxGroups {
+		return Message{}, false, ErrAssembleFull
+	}
+	if !ok || len(group.parts) != int(sum) {
+		group = &assembleGroup{
+			header: msg.HEADER,
+			parts:  make([][]byte, sum),
+		}
+		a.groups[key] = group
+	}
+	group.stamp = time.Now()
+
+	if group.parts[index-1] == nil {
+		group.recv++
+	}
+	group.parts[index-1] = msg.BODY
+	if index == 1 {
+		group.header = msg.HEADER
+	}
+
+	if group.recv < len(group.parts) {
+		return Message{}, false, nil
+	}
+
+	delete(a.groups, key)
+
+	var full Message
+	full.HEADER = group.header
+	full.HEADER.SetMulti(false)
+	full.HEADER.SeqNum = key.seqNum
+	full.HEADER.MutilFlag = MultiField{}
+	full.BODY = make([]byte, 0)
+	for _, part := range group.parts {
+		full.BODY = append(full.BODY, part...)
+	}
+	full.HEADER.SetBodyLen(len(full.BODY))
+	return full, true, nil
+}
+
+//Check return the messages which have waited longer than Timeout for missing sub packets
+//每个消息最多上报MaxRetry次，之后丢弃
+func (a *Assembler) Check(now time.Time) []Lost {
+	lostList := make([]Lost, 0)
+	for key, group := range a.groups {
+		if now.Sub(group.stamp) < a.Timeout {
+			continue
+		}
+
+		if group.retry >= a.MaxRetry {
+			delete(a.groups, key)
+			continue
+		}
+		group.retry++
+		group.stamp = now
+
+		lost := Lost{
+			MID:     key.mid,
+			Attr:    group.header.Attr,
+			SeqNum:  key.seqNum,
+			Missing: make([]uint16, 0),
+		}
+		for i, part := range group.parts {
+			if part == nil {
+				lost.Missing = append(lost.Missing, uint16(i+1))
+			}
+		}
+		lostList = append(lostList, lost)
+	}
+	return lostList
+}
+
+//RetransBody make the body of RetransReq for lost sub packets
+func RetransBody(lost Lost) []byte {
+	h := Header{Attr: lost.Attr}
+	data := make([]byte, 0)
+	data = append(data, codec.Word2Bytes(lost.SeqNum)...)
+	//2013版本重传包总数为BYTE，2019版本为WORD
+	if h.IsVer2019() {
+		data = append(data, codec.Word2Bytes(uint16(len(lost.Missing)))...)
+	} else {
+		data = append(data, byte(len(lost.Missing)))
+	}
+	for _, index := range lost.Missing {
+		data = append(data, codec.Word2Bytes(index)...)
+	}
+	return data
+}
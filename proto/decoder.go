@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"io"
+)
+
+//Decoder read messages from a stream
+//遇到损坏的帧时返回*FrameError，之后在下一个标识位处重新同步，可以继续调用Decode
+type Decoder struct {
+	r   io.Reader
+	buf []byte
+	raw []byte
+}
+
+//NewDecoder create a Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:   r,
+		buf: make([]byte, 0, 2*MaxFrameLen),
+	}
+}
+
+//Decode return the next message in the stream
+//返回*FrameError以外的错误时表示读取失败，不能继续解码
+func (d *Decoder) Decode() (Message, error) {
+	for {
+		msg, raw, lens, err := nextFrame(d.buf)
+		if lens > 0 {
+			d.raw = append(d.raw[:0], raw...)
+			d.buf = d.buf[:copy(d.buf, d.buf[lens:])]
+		}
+
+		if err != nil {
+			return Message{}, err
+		}
+
+		if raw != nil {
+			return msg, nil
+		}
+
+		if lens > 0 {
+			continue
+		}
+
+		if len(d.buf) == cap(d.buf) {
+			d.buf = append(d.buf, make([]byte, MaxFrameLen)...)[:len(d.buf)]
+		}
+		n, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+		d.buf = d.buf[:len(d.buf)+n]
+		if n == 0 && err != nil {
+			return Message{}, err
+		}
+	}
+}
+
+//Raw return the raw data with flags of the message last decoded
+func (d *Decoder) Raw() []byte {
+	return d.raw
+}
@@ -0,0 +1,58 @@
+package proto
+
+import (
+	"errors"
+)
+
+//通用应答结果
+const (
+	AckSuccess     uint8 = 0
+	AckFail        uint8 = 1
+	AckMsgErr      uint8 = 2
+	AckUnsupported uint8 = 3
+	AckAlarm       uint8 = 4
+)
+
+var (
+	ErrShortFrame   = errors.New("frame is too short")
+	ErrLongFrame    = errors.New("frame is too long")
+	ErrChecksum     = errors.New("checksum is not match")
+	ErrBadEscape    = errors.New("bad escape sequence")
+	ErrBadPhone     = errors.New("phone number is not bcd")
+	ErrUnsupported  = errors.New("message is not supported")
+	ErrBadBody      = errors.New("message body is invalid")
+	ErrNoPlatRSAKey = errors.New("platform rsa key is not set")
+	ErrBadMulti     = errors.New("sub packet index is invalid")
+	ErrAssembleFull = errors.New("too many messages are being assembled")
+	ErrBadRSAKey    = errors.New("rsa key is not 1024 bit")
+)
+
+//FrameError is the error of a corrupt frame, decoding can go on after it
+//Header只在帧头可以解析时(如校验码错误)不为nil，可用于应答终端
+type FrameError struct {
+	Frame  []byte
+	Header *Header
+	Err    error
+}
+
+func (e *FrameError) Error() string {
+	return "bad frame: " + e.Err.Error()
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+//AckResult return the general response result for err
+func AckResult(err error) uint8 {
+	switch {
+	case err == nil:
+		return AckSuccess
+	case errors.Is(err, ErrUnsupported):
+		return AckUnsupported
+	case errors.Is(err, ErrShortFrame), errors.Is(err, ErrLongFrame), errors.Is(err, ErrChecksum),
+		errors.Is(err, ErrBadEscape), errors.Is(err, ErrBadPhone), errors.Is(err, ErrBadBody), errors.Is(err, ErrBadMulti):
+		return AckMsgErr
+	}
+	return AckFail
+}
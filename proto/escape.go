@@ -0,0 +1,57 @@
+package proto
+
+import (
+	"sync"
+)
+
+//framePool is the buffer pool for unescaped frame data
+var framePool = sync.Pool{
+	New: func() interface{} {
+		buff := make([]byte, 0, MaxFrameLen)
+		return &buff
+	},
+}
+
+//AppendEscape append src to dst with 0x7e escaped to 0x7d 0x02 and 0x7d escaped to 0x7d 0x01
+func AppendEscape(dst, src []byte) []byte {
+	for _, item := range src {
+		dst = appendEscapeByte(dst, item)
+	}
+	return dst
+}
+
+func appendEscapeByte(dst []byte, item byte) []byte {
+	switch item {
+	case 0x7d:
+		return append(dst, 0x7d, 0x01)
+	case 0x7e:
+		return append(dst, 0x7d, 0x02)
+	}
+	return append(dst, item)
+}
+
+//AppendUnescape append src to dst with 0x7d 0x02 restored to 0x7e and 0x7d 0x01 restored to 0x7d
+//只扫描一遍，dst容量足够时不会分配内存
+func AppendUnescape(dst, src []byte) ([]byte, error) {
+	for i := 0; i < len(src); i++ {
+		if src[i] != 0x7d {
+			dst = append(dst, src[i])
+			continue
+		}
+
+		if i+1 >= len(src) {
+			return dst, ErrBadEscape
+		}
+
+		i++
+		switch src[i] {
+		case 0x01:
+			dst = append(dst, 0x7d)
+		case 0x02:
+			dst = append(dst, 0x7e)
+		default:
+			return dst, ErrBadEscape
+		}
+	}
+	return dst, nil
+}
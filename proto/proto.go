@@ -2,24 +2,48 @@ package proto
 
 import (
 	"bytes"
-	"fmt"
 	"tsp/codec"
-	"tsp/utils"
 )
 
 const (
 	ProtoHeader byte = 0x7e
 
-	TermAck     uint16 = 0x0001
-	Register    uint16 = 0x0100
-	RegisterAck uint16 = 0x8100
-	Unregister  uint16 = 0x0003
-	Login       uint16 = 0x0102
-	Heartbeat   uint16 = 0x0002
-	Gpsinfo     uint16 = 0x0200
-	PlatAck     uint16 = 0x8001
-	UpdateReq   uint16 = 0x8108
-	CtrlReq     uint16 = 0x8105
+	TermAck       uint16 = 0x0001
+	Register      uint16 = 0x0100
+	RegisterAck   uint16 = 0x8100
+	Unregister    uint16 = 0x0003
+	Login         uint16 = 0x0102
+	Heartbeat     uint16 = 0x0002
+	Gpsinfo       uint16 = 0x0200
+	BatchGps      uint16 = 0x0704
+	PlatAck       uint16 = 0x8001
+	RetransReq    uint16 = 0x8003
+	UpdateReq     uint16 = 0x8108
+	CtrlReq       uint16 = 0x8105
+	ParamSet      uint16 = 0x8103
+	ParamQuery    uint16 = 0x8104
+	ParamQueryAck uint16 = 0x0104
+	AttrQuery     uint16 = 0x8107
+	AttrQueryAck  uint16 = 0x0107
+	PosQuery      uint16 = 0x8201
+	PosQueryAck   uint16 = 0x0201
+	TermRSA       uint16 = 0x0A00
+	PlatRSA       uint16 = 0x8A00
+)
+
+const (
+	//HeaderLen2013 is header len without multi field for 2013 edition
+	HeaderLen2013 int = 12
+	//HeaderLen2019 is header len without multi field for 2019 edition
+	HeaderLen2019 int = 17
+
+	PhoneLen2013 int = 6
+	PhoneLen2019 int = 10
+
+	//MaxBodyLen is the max body len of one frame
+	MaxBodyLen int = 0x03FF
+	//MaxFrameLen is the max len of one frame with flags after escape
+	MaxFrameLen int = 2 + (HeaderLen2019+4+MaxBodyLen+1)*2
 )
 
 type MultiField struct {
@@ -36,33 +60,85 @@ type Header struct {
 	MutilFlag MultiField
 }
 
+//消息体属性各位定义
+const (
+	AttrBodyLen  uint16 = 0x03FF
+	AttrEncType  uint16 = 0x1C00
+	AttrMulti    uint16 = 0x2000
+	AttrVerFlag  uint16 = 0x4000
+	attrEncShift uint   = 10
+)
+
+//消息体加密方式
+const (
+	EncNone byte = 0x00
+	EncRSA  byte = 0x01
+)
+
 //IsMulti will return true if the header is multi frame
 func (h *Header) IsMulti() bool {
-	if ((h.Attr >> 12) & 0x0001) > 0 {
-		return true
-	}
-	return false
+	return (h.Attr & AttrMulti) > 0
 }
 
-//BodyLen is a function for get body len
-func (h *Header) BodyLen() int {
-	return int(h.Attr & 0x03ff)
+//SetMulti set the multi frame flag of attr
+func (h *Header) SetMulti(mut bool) {
+	if mut {
+		h.Attr = h.Attr | AttrMulti
+	} else {
+		h.Attr = h.Attr &^ AttrMulti
+	}
 }
 
-//MakeAttr is generate attr
-func MakeAttr(verFlag byte, mut bool, enc byte, lens uint16) uint16 {
-	attr := lens & 0x03FF
+//IsVer2019 will return true if the header use 2019 edition layout
+func (h *Header) IsVer2019() bool {
+	return (h.Attr & AttrVerFlag) > 0
+}
 
-	if verFlag > 0 {
-		attr = attr & 0x4000
+//SetVer2019 set the version flag of attr
+func (h *Header) SetVer2019(ver2019 bool) {
+	if ver2019 {
+		h.Attr = h.Attr | AttrVerFlag
+	} else {
+		h.Attr = h.Attr &^ AttrVerFlag
 	}
+}
 
-	if mut {
-		attr = attr & 0x2000
+//EncType return the encryption type of body
+func (h *Header) EncType() byte {
+	return byte((h.Attr & AttrEncType) >> attrEncShift)
+}
+
+//SetEncType set the encryption type of attr
+func (h *Header) SetEncType(enc byte) {
+	h.Attr = (h.Attr &^ AttrEncType) | ((uint16(enc) << attrEncShift) & AttrEncType)
+}
+
+//PhoneLen return the phone field len of the header edition
+func (h *Header) PhoneLen() int {
+	if h.IsVer2019() {
+		return PhoneLen2019
 	}
+	return PhoneLen2013
+}
+
+//BodyLen is a function for get body len
+func (h *Header) BodyLen() int {
+	return int(h.Attr & AttrBodyLen)
+}
 
-	encMask := (uint16(enc) & 0x0007) << 10
-	return attr + encMask
+//SetBodyLen set the body len of attr, lens longer than MaxBodyLen will be masked
+func (h *Header) SetBodyLen(lens int) {
+	h.Attr = (h.Attr &^ AttrBodyLen) | (uint16(lens) & AttrBodyLen)
+}
+
+//MakeAttr is generate attr
+func MakeAttr(verFlag byte, mut bool, enc byte, lens uint16) uint16 {
+	var h Header
+	h.SetVer2019(verFlag > 0)
+	h.SetMulti(mut)
+	h.SetEncType(enc)
+	h.SetBodyLen(int(lens))
+	return h.Attr
 }
 
 //Message is struct for message for jtt808
@@ -82,54 +158,75 @@ func Name() string {
 }
 
 //Filter is proto Filter api
+//返回data中所有完整的消息及已使用的长度，损坏的帧会被跳过，error为遇到的第一个*FrameError
 func Filter(data []byte) ([]Message, int, error) {
 	var usedLen int = 0
+	var firstErr error
 	msgList := make([]Message, 0)
-	var cnt int = 0
 	for {
-		//添加一个计数器，防止数据异常导致死循环
-		cnt++
-		if cnt > 10 {
-			cnt = 0
-			return []Message{}, 0, fmt.Errorf("time too much")
+		msg, raw, lens, err := nextFrame(data[usedLen:])
+		usedLen = usedLen + lens
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
-		if usedLen >= len(data) {
-			break
+
+		if raw != nil {
+			msgList = append(msgList, msg)
+			continue
 		}
 
-		msg, lens, err := filterSigle(data[usedLen:])
-		if err != nil {
-			usedLen = usedLen + lens
-			fmt.Println("err:", err)
-			return msgList, usedLen, nil
+		if lens == 0 {
+			break
 		}
-		usedLen = usedLen + lens
-		msgList = append(msgList, msg)
 	}
-	return msgList, usedLen, nil
+	return msgList, usedLen, firstErr
 }
 
-func filterSigle(data []byte) (Message, int, error) {
-	var usedLen int = 0
-
+//nextFrame parse the first frame in data
+//raw为帧原始数据(含帧头帧尾)，raw为nil且err为nil时表示此处没有可解析的帧:
+//lens>0时丢弃lens字节后继续查找，lens为0时需要更多数据
+func nextFrame(data []byte) (Message, []byte, int, error) {
 	startindex := bytes.IndexByte(data, ProtoHeader)
-	if startindex >= 0 {
-		usedLen = startindex + 1
-		endindex := bytes.IndexByte(data[usedLen:], ProtoHeader)
-		if endindex >= 0 {
-			endindex = endindex + usedLen
-
-			msg, err := frameParser(data[startindex+1 : endindex])
-			if err != nil {
-				return Message{}, endindex, err
+	if startindex < 0 {
+		return Message{}, nil, len(data), nil
+	}
+
+	endindex := bytes.IndexByte(data[startindex+1:], ProtoHeader)
+	if endindex < 0 {
+		if len(data)-startindex > MaxFrameLen {
+			return Message{}, nil, startindex + 1, &FrameError{
+				Frame: append([]byte{}, data[startindex:startindex+MaxFrameLen]...),
+				Err:   ErrLongFrame,
 			}
+		}
+		return Message{}, nil, startindex, nil
+	}
+	endindex = endindex + startindex + 1
 
-			return msg, endindex + 1, nil
+	//连续两个标识位时，后一个可能是下一帧的帧头
+	if endindex == startindex+1 {
+		return Message{}, nil, startindex + 1, nil
+	}
+
+	raw := data[startindex : endindex+1]
+	msg, err := frameParser(data[startindex+1 : endindex])
+	if err != nil {
+		ferr := &FrameError{
+			Frame: append([]byte{}, raw...),
+			Err:   err,
+		}
+		if err == ErrChecksum {
+			header := msg.HEADER
+			ferr.Header = &header
 		}
 
-		return Message{}, startindex, fmt.Errorf("can't find end flag")
+		//帧尾保留下来，以免丢失紧随其后的帧
+		return Message{}, nil, endindex, ferr
 	}
-	return Message{}, len(data), fmt.Errorf("can't find start flag")
+	return msg, raw, endindex + 1, nil
 }
 
 //Escape is function escape oldbytes to new bytes
@@ -152,20 +249,21 @@ func Escape(data, oldBytes, newBytes []byte) []byte {
 	return buff
 }
 
+//frameParser parse the data between flags
+//校验码错误时返回的Message中包含已解析的帧头
 func frameParser(data []byte) (Message, error) {
-	if len(data)+2 < 17+3 {
-		return Message{}, fmt.Errorf("header is too short")
+	//不包含帧头帧尾，反转义到复用的缓冲区中
+	bp := framePool.Get().(*[]byte)
+	defer framePool.Put(bp)
+	frameData, err := AppendUnescape((*bp)[:0], data)
+	*bp = frameData[:0]
+	if err != nil {
+		return Message{}, err
 	}
 
-	//不包含帧头帧尾
-	frameData := Escape(data[:len(data)], []byte{0x7d, 0x02}, []byte{0x7e})
-	frameData = Escape(frameData, []byte{0x7d, 0x01}, []byte{0x7d})
-
 	//之后的操作都是基于frameData来处理
-	rawcs := checkSum(frameData[:len(frameData)-1])
-
-	if rawcs != frameData[len(frameData)-1] {
-		return Message{}, fmt.Errorf("cs is not match:%d--%d", rawcs, frameData[len(frameData)-1])
+	if len(frameData) < HeaderLen2013+1 {
+		return Message{}, ErrShortFrame
 	}
 
 	var usedLen int = 0
@@ -174,12 +272,33 @@ func frameParser(data []byte) (Message, error) {
 	usedLen = usedLen + 2
 	msg.HEADER.Attr = codec.Bytes2Word(frameData[usedLen:])
 	usedLen = usedLen + 2
-	msg.HEADER.Version = frameData[usedLen]
-	usedLen = usedLen + 1
 
-	tempPhone := bytes.TrimLeftFunc(frameData[usedLen:usedLen+10], func(r rune) bool { return r == 0x00 })
-	msg.HEADER.PhoneNum = string(tempPhone)
-	usedLen = usedLen + 10
+	//2019版本带有协议版本号，手机号为10字节;2013版本手机号为6字节
+	headerLen := HeaderLen2013
+	if msg.HEADER.IsVer2019() {
+		headerLen = HeaderLen2019
+	}
+	if msg.HEADER.IsMulti() {
+		headerLen = headerLen + 4
+	}
+	if len(frameData) < headerLen+1 {
+		return Message{}, ErrShortFrame
+	}
+
+	if msg.HEADER.IsVer2019() {
+		msg.HEADER.Version = frameData[usedLen]
+		usedLen = usedLen + 1
+	}
+
+	//手机号为BCD码，去掉前补的0
+	phoneLen := msg.HEADER.PhoneLen()
+	var digits [PhoneLen2019 * 2]byte
+	phone, err := codec.AppendDigits(digits[:0], frameData[usedLen:usedLen+phoneLen])
+	if err != nil {
+		return Message{}, ErrBadPhone
+	}
+	msg.HEADER.PhoneNum = string(bytes.TrimLeft(phone, "0"))
+	usedLen = usedLen + phoneLen
 	msg.HEADER.SeqNum = codec.Bytes2Word(frameData[usedLen:])
 	usedLen = usedLen + 2
 
@@ -190,13 +309,13 @@ func frameParser(data []byte) (Message, error) {
 		usedLen = usedLen + 2
 	}
 
-	if len(frameData) < usedLen {
-		return Message{}, fmt.Errorf("flag code is too short")
+	rawcs := checkSum(frameData[:len(frameData)-1])
+	if rawcs != frameData[len(frameData)-1] {
+		return Message{HEADER: msg.HEADER}, ErrChecksum
 	}
 
-	msg.BODY = make([]byte, len(frameData)-usedLen)
-	copy(msg.BODY, frameData[usedLen:len(frameData)])
-	usedLen = len(frameData)
+	msg.BODY = make([]byte, len(frameData)-1-usedLen)
+	copy(msg.BODY, frameData[usedLen:len(frameData)-1])
 
 	return msg, nil
 }
@@ -210,51 +329,72 @@ func checkSum(data []byte) byte {
 }
 
 //Packer is proto Packer api
+//属性中除消息体长度外的各位均取自msg.HEADER.Attr，帧格式跟随其中的版本标识
+//消息体超过MaxBodyLen时需要使用PackerMulti
 func Packer(msg Message) []byte {
-	data := make([]byte, 0)
-	tempbytes := codec.Word2Bytes(msg.HEADER.MID)
-	data = append(data, tempbytes...)
-	datalen := uint16(len(msg.BODY)) & 0x03FF
-	datalen = datalen | 0x4000
+	return AppendPacker(make([]byte, 0, 2+(HeaderLen2019+4+len(msg.BODY)+1)*2), msg)
+}
 
-	tempbytes = utils.Word2Bytes(datalen)
-	data = append(data, tempbytes...)
+//AppendPacker append the frame of msg to dst and return the extended buffer
+//dst容量足够时不会分配内存
+func AppendPacker(dst []byte, msg Message) []byte {
+	msg.HEADER.SetBodyLen(len(msg.BODY))
 
-	data = append(data, msg.HEADER.Version)
+	var head [HeaderLen2019 + 4]byte
+	data := head[:0]
+	data = append(data, byte(msg.HEADER.MID>>8), byte(msg.HEADER.MID))
+	data = append(data, byte(msg.HEADER.Attr>>8), byte(msg.HEADER.Attr))
 
-	if len(msg.HEADER.PhoneNum) < 10 {
-		data = append(data, make([]byte, 10-len(msg.HEADER.PhoneNum))...)
-		data = append(data, msg.HEADER.PhoneNum...)
-	} else {
-		data = append(data, msg.HEADER.PhoneNum[:10]...)
+	if msg.HEADER.IsVer2019() {
+		data = append(data, msg.HEADER.Version)
 	}
 
-	tempbytes = utils.Word2Bytes(msg.HEADER.SeqNum)
-	data = append(data, tempbytes...)
+	//PhoneNum来自已解析的帧头，非数字字符按0编码
+	data, _ = codec.AppendBCD(data, msg.HEADER.PhoneNum, msg.HEADER.PhoneLen())
+
+	data = append(data, byte(msg.HEADER.SeqNum>>8), byte(msg.HEADER.SeqNum))
 
 	if msg.HEADER.IsMulti() {
-		data = append(data, utils.Word2Bytes(msg.HEADER.MutilFlag.MsgSum)...)
-		data = append(data, utils.Word2Bytes(msg.HEADER.MutilFlag.MsgIndex)...)
+		data = append(data, byte(msg.HEADER.MutilFlag.MsgSum>>8), byte(msg.HEADER.MutilFlag.MsgSum))
+		data = append(data, byte(msg.HEADER.MutilFlag.MsgIndex>>8), byte(msg.HEADER.MutilFlag.MsgIndex))
 	}
 
-	data = append(data, msg.BODY...)
-
-	csdata := byte(checkSum(data[:]))
-	data = append(data, csdata)
+	cs := checkSum(data) ^ checkSum(msg.BODY)
 
 	//添加头尾
-	var tmpdata []byte = []byte{0x7e}
+	dst = append(dst, ProtoHeader)
+	dst = AppendEscape(dst, data)
+	dst = AppendEscape(dst, msg.BODY)
+	dst = appendEscapeByte(dst, cs)
+	dst = append(dst, ProtoHeader)
 
-	for _, item := range data {
-		if item == 0x7d {
-			tmpdata = append(tmpdata, 0x7d, 0x01)
-		} else if item == 0x7e {
-			tmpdata = append(tmpdata, 0x7d, 0x02)
-		} else {
-			tmpdata = append(tmpdata, item)
-		}
+	return dst
+}
+
+//PackerMulti is proto Packer api for message which may be longer than MaxBodyLen
+//消息体过长时拆分为多个分包，分包流水号从msg.HEADER.SeqNum开始依次递增
+func PackerMulti(msg Message) [][]byte {
+	if len(msg.BODY) <= MaxBodyLen {
+		return [][]byte{Packer(msg)}
 	}
-	tmpdata = append(tmpdata, 0x7e)
 
-	return tmpdata
+	sum := (len(msg.BODY) + MaxBodyLen - 1) / MaxBodyLen
+	frames := make([][]byte, 0, sum)
+	for i := 0; i < sum; i++ {
+		end := (i + 1) * MaxBodyLen
+		if end > len(msg.BODY) {
+			end = len(msg.BODY)
+		}
+
+		part := msg
+		part.HEADER.SetMulti(true)
+		part.HEADER.SeqNum = msg.HEADER.SeqNum + uint16(i)
+		part.HEADER.MutilFlag = MultiField{
+			MsgSum:   uint16(sum),
+			MsgIndex: uint16(i + 1),
+		}
+		part.BODY = msg.BODY[i*MaxBodyLen : end]
+		frames = append(frames, Packer(part))
+	}
+	return frames
 }
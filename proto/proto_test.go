@@ -1,11 +1,19 @@
 package proto
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"math/big"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestFilter(t *testing.T) {
-	data := []byte{ProtoHeader, 0x00, 0x01, 0x00, 0x03, 0x01, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x01, 0x12, 0x34, 0x56}
+	data := []byte{ProtoHeader, 0x00, 0x01, 0x40, 0x03, 0x01, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x31, 0x01, 0x12, 0x34, 0x56}
 	cs := checkSum(data[1:])
 	data = append(data, cs, ProtoHeader)
 	t.Log("data:", data)
@@ -47,3 +55,547 @@ func TestEscape(t *testing.T) {
 	data1 := Escape(data, []byte{0x7d, 0x02}, []byte{0x7d})
 	t.Log("data1:", data1)
 }
+
+func TestFrameParser2013(t *testing.T) {
+	data := []byte{0x00, 0x02, 0x00, 0x00, 0x01, 0x38, 0x00, 0x12, 0x34, 0x56, 0x00, 0x07}
+	data = append(data, checkSum(data))
+
+	msg, err := frameParser(data)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+
+	if msg.HEADER.IsVer2019() {
+		t.Errorf("header should be 2013 edition")
+	}
+	if msg.HEADER.MID != Heartbeat || msg.HEADER.SeqNum != 0x0007 {
+		t.Errorf("header:%+v", msg.HEADER)
+	}
+	if msg.HEADER.PhoneNum != "13800123456" {
+		t.Errorf("phone:%x", msg.HEADER.PhoneNum)
+	}
+	if len(msg.BODY) != 0 {
+		t.Errorf("body:%x", msg.BODY)
+	}
+}
+
+func TestFrameParser2019(t *testing.T) {
+	data := []byte{0x00, 0x02, 0x40, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x38, 0x00, 0x12, 0x34, 0x56, 0x00, 0x07, 0xAA}
+	data = append(data, checkSum(data))
+
+	msg, err := frameParser(data)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+
+	if !msg.HEADER.IsVer2019() {
+		t.Errorf("header should be 2019 edition")
+	}
+	if msg.HEADER.Version != 1 || msg.HEADER.SeqNum != 0x0007 {
+		t.Errorf("header:%+v", msg.HEADER)
+	}
+	if msg.HEADER.PhoneNum != "13800123456" {
+		t.Errorf("phone:%x", msg.HEADER.PhoneNum)
+	}
+	if !bytes.Equal(msg.BODY, []byte{0xAA}) {
+		t.Errorf("body:%x", msg.BODY)
+	}
+}
+
+func TestPackerEdition(t *testing.T) {
+	for _, verFlag := range []byte{0, 1} {
+		msg := Message{
+			HEADER: Header{
+				MID:      PlatAck,
+				Attr:     MakeAttr(verFlag, false, 0, 5),
+				Version:  1,
+				PhoneNum: "13800123456",
+				SeqNum:   0x1234,
+			},
+			BODY: []byte{0x00, 0x07, 0x00, 0x02, 0x00},
+		}
+
+		data := Packer(msg)
+		msgs, _, err := Filter(data)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("verFlag:%d, msgs:%v, err:%v", verFlag, msgs, err)
+		}
+
+		if msgs[0].HEADER.IsVer2019() != (verFlag > 0) {
+			t.Errorf("verFlag:%d, edition not match", verFlag)
+		}
+		if msgs[0].HEADER.PhoneNum != msg.HEADER.PhoneNum || msgs[0].HEADER.SeqNum != msg.HEADER.SeqNum {
+			t.Errorf("verFlag:%d, header:%+v", verFlag, msgs[0].HEADER)
+		}
+		if !bytes.Equal(msgs[0].BODY, msg.BODY) {
+			t.Errorf("verFlag:%d, body:%x", verFlag, msgs[0].BODY)
+		}
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	a := NewAssembler(AssembleTimeout, AssembleRetry)
+
+	parts := [][]byte{{0x01, 0x02}, {0x03}, {0x04, 0x05}}
+	makePart := func(index int) Message {
+		return Message{
+			HEADER: Header{
+				MID:       Gpsinfo,
+				Attr:      MakeAttr(1, true, 0, uint16(len(parts[index]))),
+				SeqNum:    uint16(0xFFFF + index),
+				MutilFlag: MultiField{MsgSum: uint16(len(parts)), MsgIndex: uint16(index + 1)},
+			},
+			BODY: parts[index],
+		}
+	}
+
+	for _, index := range []int{2, 0} {
+		if _, ok, err := a.Push(makePart(index)); ok || err != nil {
+			t.Fatalf("index:%d should not complete, err:%v", index, err)
+		}
+	}
+
+	lost := a.Check(time.Now().Add(AssembleTimeout))
+	if len(lost) != 1 || lost[0].SeqNum != 0xFFFF || len(lost[0].Missing) != 1 || lost[0].Missing[0] != 2 {
+		t.Fatalf("lost:%+v", lost)
+	}
+	if !bytes.Equal(RetransBody(lost[0]), []byte{0xFF, 0xFF, 0x00, 0x01, 0x00, 0x02}) {
+		t.Errorf("retrans body:%x", RetransBody(lost[0]))
+	}
+
+	msg, ok, _ := a.Push(makePart(1))
+	if !ok {
+		t.Fatalf("message should complete")
+	}
+	if msg.HEADER.IsMulti() || msg.HEADER.SeqNum != 0xFFFF {
+		t.Errorf("header:%+v", msg.HEADER)
+	}
+	if !bytes.Equal(msg.BODY, []byte{0x01, 0x02, 0x03, 0x04, 0x05}) {
+		t.Errorf("body:%x", msg.BODY)
+	}
+	if len(a.Check(time.Now().Add(AssembleTimeout))) != 0 {
+		t.Errorf("buffer should be empty")
+	}
+
+	//分包总数超过上限或同时组包的消息过多时拒绝
+	big := makePart(0)
+	big.HEADER.MutilFlag.MsgSum = AssembleMaxSum + 1
+	if _, _, err := a.Push(big); err != ErrBadMulti {
+		t.Errorf("big sum err:%v", err)
+	}
+	for i := 0; i < AssembleMaxGroups; i++ {
+		part := makePart(0)
+		part.HEADER.SeqNum = uint16(i * 10)
+		if _, _, err := a.Push(part); err != nil {
+			t.Fatalf("group:%d, err:%v", i, err)
+		}
+	}
+	part := makePart(0)
+	part.HEADER.SeqNum = 0x1000
+	if _, _, err := a.Push(part); err != ErrAssembleFull {
+		t.Errorf("full err:%v", err)
+	}
+}
+
+func TestPackerMulti(t *testing.T) {
+	body := make([]byte, 2*MaxBodyLen+100)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	msg := Message{
+		HEADER: Header{
+			MID:      0x8300,
+			Attr:     MakeAttr(1, false, 0, 0),
+			Version:  1,
+			PhoneNum: "13800123456",
+			SeqNum:   0xFFFE,
+		},
+		BODY: body,
+	}
+
+	frames := PackerMulti(msg)
+	if len(frames) != 3 {
+		t.Fatalf("frames:%d", len(frames))
+	}
+
+	a := NewAssembler(AssembleTimeout, AssembleRetry)
+	for i, frame := range frames {
+		msgs, _, err := Filter(frame)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("index:%d, err:%v", i, err)
+		}
+
+		part := msgs[0]
+		if !part.HEADER.IsMulti() || part.HEADER.MutilFlag.MsgSum != 3 || part.HEADER.MutilFlag.MsgIndex != uint16(i+1) {
+			t.Errorf("index:%d, header:%+v", i, part.HEADER)
+		}
+		if part.HEADER.SeqNum != 0xFFFE+uint16(i) {
+			t.Errorf("index:%d, seq:%d", i, part.HEADER.SeqNum)
+		}
+		if part.HEADER.BodyLen() != len(part.BODY) || len(part.BODY) > MaxBodyLen {
+			t.Errorf("index:%d, bodylen:%d", i, len(part.BODY))
+		}
+
+		full, ok, err := a.Push(part)
+		if err != nil || ok != (i == len(frames)-1) {
+			t.Fatalf("index:%d, complete:%v", i, ok)
+		}
+		if ok && !bytes.Equal(full.BODY, body) {
+			t.Errorf("body not match")
+		}
+	}
+
+	if frames = PackerMulti(Message{HEADER: msg.HEADER, BODY: body[:10]}); len(frames) != 1 {
+		t.Errorf("short body frames:%d", len(frames))
+	}
+}
+
+func TestAttr(t *testing.T) {
+	attr := MakeAttr(1, true, EncRSA, 0x0155)
+	if attr != 0x4000|0x2000|0x0400|0x0155 {
+		t.Fatalf("attr:%04x", attr)
+	}
+
+	h := Header{Attr: attr}
+	if !h.IsVer2019() || !h.IsMulti() || h.EncType() != EncRSA || h.BodyLen() != 0x0155 {
+		t.Errorf("header:%+v", h)
+	}
+
+	h.SetVer2019(false)
+	h.SetMulti(false)
+	h.SetEncType(EncNone)
+	h.SetBodyLen(MaxBodyLen + 2)
+	if h.IsVer2019() || h.IsMulti() || h.EncType() != EncNone || h.BodyLen() != 1 {
+		t.Errorf("header:%+v", h)
+	}
+
+	h.SetEncType(0x07)
+	if h.Attr != AttrEncType|0x0001 {
+		t.Errorf("attr:%04x", h.Attr)
+	}
+}
+
+func TestPackerAttr(t *testing.T) {
+	msg := Message{
+		HEADER: Header{
+			MID:      PlatAck,
+			Attr:     MakeAttr(1, false, EncRSA, 0x0300),
+			Version:  1,
+			PhoneNum: "13800123456",
+			SeqNum:   0x0001,
+		},
+		BODY: []byte{0x01, 0x02, 0x03},
+	}
+
+	msgs, _, err := Filter(Packer(msg))
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("msgs:%v, err:%v", msgs, err)
+	}
+
+	if msgs[0].HEADER.Attr != MakeAttr(1, false, EncRSA, 3) {
+		t.Errorf("attr:%04x", msgs[0].HEADER.Attr)
+	}
+}
+
+func TestRSABody(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, RSAKeyLen*8)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+
+	body := make([]byte, 300)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	data, err := EncryptBody(&priv.PublicKey, body)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if len(data) != 3*RSAKeyLen {
+		t.Errorf("encrypt len:%d", len(data))
+	}
+
+	plain, err := DecryptBody(priv, data)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if !bytes.Equal(plain, body) {
+		t.Errorf("body not match")
+	}
+
+	if _, err = DecryptBody(priv, data[1:]); err == nil {
+		t.Errorf("truncated body should fail")
+	}
+
+	if err = CheckRSAKey(&priv.PublicKey); err != nil {
+		t.Errorf("check key err:%v", err)
+	}
+	if err = CheckRSAKey(&rsa.PublicKey{N: priv.N, E: 1}); !errors.Is(err, ErrBadRSAKey) {
+		t.Errorf("exponent 1 err:%v", err)
+	}
+	short := &rsa.PublicKey{N: new(big.Int).Rsh(priv.N, 8), E: priv.E}
+	if err = CheckRSAKey(short); err != ErrBadRSAKey {
+		t.Errorf("short key err:%v", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	makeFrame := func(seq uint16) []byte {
+		return Packer(Message{
+			HEADER: Header{
+				MID:      Heartbeat,
+				Attr:     MakeAttr(1, false, 0, 0),
+				Version:  1,
+				PhoneNum: "13800123456",
+				SeqNum:   seq,
+			},
+		})
+	}
+
+	bad := makeFrame(2)
+	bad[len(bad)-2] ^= 0xFF
+
+	stream := []byte{0x00, 0x7d, 0x11}
+	stream = append(stream, makeFrame(1)...)
+	stream = append(stream, bad...)
+	stream = append(stream, makeFrame(3)...)
+	stream = append(stream, 0x12, 0x7e, 0x01, 0x02)
+	stream = append(stream, makeFrame(4)...)
+	for i := 5; i < 20; i++ {
+		stream = append(stream, makeFrame(uint16(i))...)
+	}
+
+	dec := NewDecoder(iotest.OneByteReader(bytes.NewReader(stream)))
+	seqs := make([]uint16, 0)
+	errCnt := 0
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+
+		if ferr, ok := err.(*FrameError); ok {
+			errCnt++
+			t.Log("err:", ferr, ferr.Frame)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err:%s", err.Error())
+		}
+
+		if !bytes.Equal(dec.Raw(), makeFrame(msg.HEADER.SeqNum)) {
+			t.Errorf("raw:%x", dec.Raw())
+		}
+		seqs = append(seqs, msg.HEADER.SeqNum)
+	}
+
+	if errCnt != 2 {
+		t.Errorf("errCnt:%d", errCnt)
+	}
+	if len(seqs) != 18 || seqs[0] != 1 || seqs[1] != 3 || seqs[2] != 4 || seqs[17] != 19 {
+		t.Errorf("seqs:%v", seqs)
+	}
+
+	msgs, lens, err := Filter(stream)
+	if len(msgs) != 18 || lens != len(stream) {
+		t.Errorf("msgs:%d, lens:%d", len(msgs), lens)
+	}
+	if _, ok := err.(*FrameError); !ok {
+		t.Errorf("err:%v", err)
+	}
+}
+
+func TestFrameError(t *testing.T) {
+	frame := Packer(Message{
+		HEADER: Header{
+			MID:      Heartbeat,
+			Attr:     MakeAttr(1, false, 0, 0),
+			Version:  1,
+			PhoneNum: "13800123456",
+			SeqNum:   0x0009,
+		},
+	})
+
+	badcs := append([]byte{}, frame...)
+	badcs[len(badcs)-2] ^= 0x01
+
+	badesc := append([]byte{}, frame[:3]...)
+	badesc = append(badesc, 0x7d, 0x03)
+	badesc = append(badesc, frame[3:]...)
+
+	cases := []struct {
+		data   []byte
+		err    error
+		result uint8
+	}{
+		{badcs, ErrChecksum, AckMsgErr},
+		{badesc, ErrBadEscape, AckMsgErr},
+		{[]byte{0x7e, 0x00, 0x02, 0x40, 0x00, 0x7e}, ErrShortFrame, AckMsgErr},
+		{append([]byte{0x7e}, make([]byte, MaxFrameLen)...), ErrLongFrame, AckMsgErr},
+	}
+
+	for i, c := range cases {
+		_, _, err := Filter(c.data)
+		ferr, ok := err.(*FrameError)
+		if !ok {
+			t.Fatalf("case:%d, err:%v", i, err)
+		}
+		if !errors.Is(err, c.err) || AckResult(err) != c.result {
+			t.Errorf("case:%d, err:%v", i, err)
+		}
+		if (ferr.Header != nil) != (c.err == ErrChecksum) {
+			t.Errorf("case:%d, header:%v", i, ferr.Header)
+		}
+		if ferr.Header != nil && ferr.Header.SeqNum != 0x0009 {
+			t.Errorf("case:%d, header:%+v", i, ferr.Header)
+		}
+	}
+
+	if AckResult(nil) != AckSuccess || AckResult(ErrUnsupported) != AckUnsupported || AckResult(io.EOF) != AckFail {
+		t.Errorf("ack result not match")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	type testBody struct {
+		Value uint16
+		Name  string
+	}
+	type testBody2013 struct {
+		Value uint8
+	}
+
+	RegisterMsg(MsgType{ID: 0x0F01, Name: "test", Dir: DirUp, Body: &testBody{}, Body2013: &testBody2013{}})
+	RegisterMsg(MsgType{ID: 0x0F02, Name: "empty", Dir: DirDown})
+
+	mt, ok := Lookup(0x0F01)
+	if !ok || mt.Name != "test" || mt.Dir != DirUp {
+		t.Fatalf("mt:%+v", mt)
+	}
+
+	msg := Message{
+		HEADER: Header{MID: 0x0F01, Attr: MakeAttr(1, false, 0, 4)},
+		BODY:   []byte{0x12, 0x34, 0x41, 0x42},
+	}
+	body, err := DecodeBody(msg)
+	if err != nil {
+		t.Fatalf("err:%s", err.Error())
+	}
+	if b, ok := body.(*testBody); !ok || b.Value != 0x1234 || b.Name != "AB" {
+		t.Errorf("body:%+v", body)
+	}
+	t.Log("describe:", Describe(msg))
+
+	msg.HEADER.SetVer2019(false)
+	body, err = DecodeBody(msg)
+	if b, ok := body.(*testBody2013); err != nil || !ok || b.Value != 0x12 {
+		t.Errorf("body:%+v, err:%v", body, err)
+	}
+
+	msg.BODY = []byte{}
+	msg.HEADER.SetVer2019(true)
+	if _, err = DecodeBody(msg); !errors.Is(err, ErrBadBody) {
+		t.Errorf("err:%v", err)
+	}
+
+	if body, err = DecodeBody(Message{HEADER: Header{MID: 0x0F02}}); body != nil || err != nil {
+		t.Errorf("body:%+v, err:%v", body, err)
+	}
+
+	if _, err = DecodeBody(Message{HEADER: Header{MID: 0x0F03}}); err != ErrUnsupported {
+		t.Errorf("err:%v", err)
+	}
+}
+
+func benchMessage() Message {
+	body := make([]byte, 28)
+	for i := range body {
+		body[i] = byte(0x70 + i)
+	}
+	return Message{
+		HEADER: Header{
+			MID:      Gpsinfo,
+			Attr:     MakeAttr(1, false, 0, 0),
+			Version:  1,
+			PhoneNum: "13800123456",
+			SeqNum:   0x7e7d,
+		},
+		BODY: body,
+	}
+}
+
+func TestZeroAlloc(t *testing.T) {
+	msg := benchMessage()
+	frame := Packer(msg)
+	buff := make([]byte, 0, MaxFrameLen)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buff = AppendPacker(buff[:0], msg)
+	})
+	if allocs != 0 || !bytes.Equal(buff, frame) {
+		t.Errorf("AppendPacker allocs:%v", allocs)
+	}
+
+	allocs = testing.AllocsPerRun(100, func() {
+		buff, _ = AppendUnescape(buff[:0], frame[1:len(frame)-1])
+	})
+	if allocs != 0 {
+		t.Errorf("AppendUnescape allocs:%v", allocs)
+	}
+
+	escaped := AppendEscape(nil, buff)
+	if !bytes.Equal(escaped, frame[1:len(frame)-1]) {
+		t.Errorf("escape:%x", escaped)
+	}
+}
+
+func BenchmarkPacker(b *testing.B) {
+	msg := benchMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Packer(msg)
+	}
+}
+
+func BenchmarkAppendPacker(b *testing.B) {
+	msg := benchMessage()
+	buff := make([]byte, 0, MaxFrameLen)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buff = AppendPacker(buff[:0], msg)
+	}
+}
+
+func BenchmarkAppendUnescape(b *testing.B) {
+	frame := Packer(benchMessage())
+	buff := make([]byte, 0, MaxFrameLen)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buff, _ = AppendUnescape(buff[:0], frame[1:len(frame)-1])
+	}
+}
+
+func BenchmarkFrameParser(b *testing.B) {
+	frame := Packer(benchMessage())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		frameParser(frame[1 : len(frame)-1])
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	frame := Packer(benchMessage())
+	stream := bytes.Repeat(frame, 1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream)))
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(bytes.NewReader(stream))
+		for {
+			if _, err := dec.Decode(); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package proto
+
+import (
+	"fmt"
+	"reflect"
+	"tsp/codec"
+)
+
+//Direction is the direction of a message
+type Direction uint8
+
+const (
+	//DirUp is message from terminal to platform
+	DirUp Direction = iota + 1
+	//DirDown is message from platform to terminal
+	DirDown
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirUp:
+		return "up"
+	case DirDown:
+		return "down"
+	}
+	return "unknown"
+}
+
+//MsgType describe a message registered in the registry
+//Body为消息体结构的指针，消息体为空时为nil；Body2013为2013版本不同于2019版本时的消息体
+type MsgType struct {
+	ID       uint16
+	Name     string
+	Dir      Direction
+	Body     interface{}
+	Body2013 interface{}
+}
+
+var registry = make(map[uint16]MsgType)
+
+//RegisterMsg add a message type to the registry, it should be called in init
+func RegisterMsg(mt MsgType) {
+	if _, ok := registry[mt.ID]; ok {
+		panic(fmt.Sprintf("proto: message 0x%04X is registered twice", mt.ID))
+	}
+	registry[mt.ID] = mt
+}
+
+//Lookup return the registered message type of mid
+func Lookup(mid uint16) (MsgType, bool) {
+	mt, ok := registry[mid]
+	return mt, ok
+}
+
+//NewBody return a new empty body struct for msg by its MID and edition
+//返回消息体结构的指针，消息体为空的消息返回nil
+func NewBody(msg Message) (interface{}, error) {
+	mt, ok := registry[msg.HEADER.MID]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	sample := mt.Body
+	if !msg.HEADER.IsVer2019() && mt.Body2013 != nil {
+		sample = mt.Body2013
+	}
+	if sample == nil {
+		return nil, nil
+	}
+	return reflect.New(reflect.TypeOf(sample).Elem()).Interface(), nil
+}
+
+//DecodeBody decode the body of msg into a new body struct of the registered type
+//返回消息体结构的指针，消息体为空的消息返回nil
+func DecodeBody(msg Message) (interface{}, error) {
+	body, err := NewBody(msg)
+	if body == nil {
+		return nil, err
+	}
+
+	if _, err := codec.Unmarshal(msg.BODY, body); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadBody, err.Error())
+	}
+	return body, nil
+}
+
+//Describe return a readable string of msg for log
+func Describe(msg Message) string {
+	mt, ok := registry[msg.HEADER.MID]
+	if !ok {
+		return fmt.Sprintf("unknown(0x%04X) seq:%d body:% X", msg.HEADER.MID, msg.HEADER.SeqNum, msg.BODY)
+	}
+
+	body, err := DecodeBody(msg)
+	if err != nil {
+		return fmt.Sprintf("%s(0x%04X) seq:%d err:%s body:% X", mt.Name, mt.ID, msg.HEADER.SeqNum, err.Error(), msg.BODY)
+	}
+	if body == nil {
+		return fmt.Sprintf("%s(0x%04X) seq:%d body:% X", mt.Name, mt.ID, msg.HEADER.SeqNum, msg.BODY)
+	}
+	return fmt.Sprintf("%s(0x%04X) seq:%d %+v", mt.Name, mt.ID, msg.HEADER.SeqNum, reflect.ValueOf(body).Elem().Interface())
+}
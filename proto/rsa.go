@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+//RSAKeyLen is the modulus len of the key in TermRSA and PlatRSA body
+const RSAKeyLen int = 128
+
+//CheckRSAKey check the public key is a 1024 bit key with a valid exponent
+func CheckRSAKey(pub *rsa.PublicKey) error {
+	if pub.N == nil || pub.N.BitLen() != RSAKeyLen*8 {
+		return ErrBadRSAKey
+	}
+	if pub.E <= 1 {
+		return fmt.Errorf("%w: exponent %d", ErrBadRSAKey, pub.E)
+	}
+	return nil
+}
+
+//EncryptBody encrypt body with the public key of the receiver
+//按密钥长度分块，每块采用PKCS#1 v1.5填充加密
+func EncryptBody(pub *rsa.PublicKey, body []byte) ([]byte, error) {
+	blockLen := pub.Size() - 11
+	data := make([]byte, 0, (len(body)/blockLen+1)*pub.Size())
+	for start := 0; start < len(body); start = start + blockLen {
+		end := start + blockLen
+		if end > len(body) {
+			end = len(body)
+		}
+
+		block, err := rsa.EncryptPKCS1v15(rand.Reader, pub, body[start:end])
+		if err != nil {
+			return []byte{}, err
+		}
+		data = append(data, block...)
+	}
+	return data, nil
+}
+
+//DecryptBody decrypt body with the private key of the platform
+func DecryptBody(priv *rsa.PrivateKey, body []byte) ([]byte, error) {
+	blockLen := priv.Size()
+	if len(body)%blockLen != 0 {
+		return []byte{}, fmt.Errorf("%w: len %d is not a multiple of key len %d", ErrBadBody, len(body), blockLen)
+	}
+
+	data := make([]byte, 0, len(body))
+	for start := 0; start < len(body); start = start + blockLen {
+		block, err := rsa.DecryptPKCS1v15(rand.Reader, priv, body[start:start+blockLen])
+		if err != nil {
+			return []byte{}, err
+		}
+		data = append(data, block...)
+	}
+	return data, nil
+}
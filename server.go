@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"tsp/term"
@@ -20,6 +23,12 @@ import (
 	"net/http"
 
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"expvar"
+	"io/ioutil"
 
 	"github.com/BurntSushi/toml"
 	"github.com/dgrijalva/jwt-go"
@@ -61,10 +70,12 @@ type DevPage struct {
 }
 
 type Config struct {
-	TcpCfg TcpConfig `toml:"tcp"`
-	WebCfg WebConfig `toml:"web"`
-	MapCfg MapConfig `toml:"map"`
-	PgCfg  PgConfig  `toml:"postgresql"`
+	TcpCfg  TcpConfig  `toml:"tcp"`
+	WebCfg  WebConfig  `toml:"web"`
+	MapCfg  MapConfig  `toml:"map"`
+	PgCfg   PgConfig   `toml:"postgresql"`
+	RsaCfg  RsaConfig  `toml:"rsa"`
+	TermCfg TermConfig `toml:"term"`
 }
 
 type TcpConfig struct {
@@ -75,6 +86,8 @@ type TcpConfig struct {
 type WebConfig struct {
 	Ip   string
 	Port int
+	//RequestTimeout is the max seconds an api waits for the terminal, 为0时使用30秒
+	RequestTimeout int
 }
 
 type MapConfig struct {
@@ -88,93 +101,135 @@ type PgConfig struct {
 	Password  string
 }
 
+type RsaConfig struct {
+	KeyFile string
+}
+
+//TermConfig is the retransmission of platform requests, 为0时使用term包的默认值
+type TermConfig struct {
+	AckTimeout int //首次等待应答的秒数
+	AckRetries int //重传次数
+}
+
 //var connList []net.Conn
 var connManger map[string]*term.Terminal
 
+//connMutex guard connManger, 接收goroutine增删连接，http处理函数读取
+var connMutex sync.RWMutex
+
 var ipaddress string
 
 var engine *xorm.Engine
 
 var config Config
 
+var rsaKey *rsa.PrivateKey
+
+//frameErrors count the corrupt frames by error, 通过/debug/vars查看
+var frameErrors = expvar.NewMap("frame_errors")
+
 func recvConnMsg(conn net.Conn) {
-	buf := make([]byte, 0)
 	addr := conn.RemoteAddr()
 	log.WithFields(logrus.Fields{"network": addr.Network(), "ip": addr.String()}).Info("recv")
 
 	var t *term.Terminal = &term.Terminal{
-		Conn:   conn,
-		Engine: engine,
-		Ch:     make(chan int),
+		Conn:       conn,
+		Engine:     engine,
+		RSAKey:     rsaKey,
+		AckTimeout: time.Duration(config.TermCfg.AckTimeout) * time.Second,
+		AckRetries: config.TermCfg.AckRetries,
+		OnWrite: func(data []byte) {
+			logFrame(1, data)
+		},
 	}
+	connMutex.Lock()
 	connManger[addr.String()] = t
+	connMutex.Unlock()
 	ipaddress = addr.String()
 
+	//分包超时检查不依赖终端继续发送数据
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				t.CheckLost(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
 	defer func() {
+		close(done)
+		connMutex.Lock()
 		delete(connManger, addr.String())
+		connMutex.Unlock()
+		t.Close()
 		conn.Close()
 	}()
 
+	dec := proto.NewDecoder(conn)
 	for {
-		tempbuf := make([]byte, 1024)
-		n, err := conn.Read(tempbuf)
+		msg, err := dec.Decode()
+		if ferr, ok := err.(*proto.FrameError); ok {
+			logFrame(0, ferr.Frame)
+			log.WithFields(logrus.Fields{"ip": addr.String(), "error": ferr.Error()}).Info("frame")
+			frameErrors.Add(ferr.Err.Error(), 1)
+
+			sendBuf := t.ErrorAck(ferr)
+			if len(sendBuf) > 0 {
+				logFrame(1, sendBuf)
+				conn.Write(sendBuf)
+			}
+			continue
+		}
 
 		if err != nil {
 			log.WithFields(logrus.Fields{"network": addr.Network(), "ip": addr.String()}).Info("closed")
 			return
 		}
 
-		buf = append(buf, tempbuf[:n]...)
-		var outlog string
-		for _, val := range buf {
-			outlog += fmt.Sprintf("%02X", val)
-		}
-		log.WithFields(logrus.Fields{"data": outlog}).Info("<--- ")
-
-		logframe := new(LogFrame)
-		logframe.Stamp = time.Now()
-		logframe.Dir = 0
-		logframe.Frame = outlog
-		_, err = engine.Insert(logframe)
-		if err != nil {
-			log.WithFields(logrus.Fields{"error": err.Error()}).Info("insert")
+		logFrame(0, dec.Raw())
+		//Describe会再次解析消息体，只在debug级别输出
+		if log.IsLevelEnabled(logrus.DebugLevel) {
+			log.WithFields(logrus.Fields{"msg": proto.Describe(msg)}).Debug("recv")
+		} else {
+			log.WithFields(logrus.Fields{"mid": fmt.Sprintf("0x%04X", msg.HEADER.MID), "seq": msg.HEADER.SeqNum}).Info("recv")
 		}
 
-		var msg []proto.Message
-		var lens int
-		msg, lens, err = proto.Filter(buf)
-		if err != nil {
-			//
+		//处理消息
+		sendBuf := t.Handler(msg)
+		if len(sendBuf) > 0 {
+			logFrame(1, sendBuf)
+			conn.Write(sendBuf)
 		}
+	}
+}
 
-		buf = buf[lens:]
-
-		for len(msg) > 0 {
-			//处理消息
-			sendBuf := t.Handler(msg[0])
-
-			if sendBuf != nil {
-				outlog = ""
-				for _, val := range sendBuf {
-					outlog += fmt.Sprintf("%02X", val)
-				}
-				log.WithFields(logrus.Fields{"data": outlog}).Info("---> ")
-
-				logframe := &LogFrame{
-					Stamp: time.Now(),
-					Dir:   1,
-					Frame: outlog,
-				}
-				_, err = engine.Insert(logframe)
-				if err != nil {
-					log.WithFields(logrus.Fields{"error": err.Error()}).Info("insert")
-				}
+//logFrame output the frame to log and save it to log_frame table, dir 0:终端到平台 1:平台到终端
+func logFrame(dir int, data []byte) {
+	var outlog string
+	for _, val := range data {
+		outlog += fmt.Sprintf("%02X", val)
+	}
 
-				conn.Write(sendBuf)
+	if dir == 0 {
+		log.WithFields(logrus.Fields{"data": outlog}).Info("<--- ")
+	} else {
+		log.WithFields(logrus.Fields{"data": outlog}).Info("---> ")
+	}
 
-				msg = msg[1:]
-			}
-		}
+	logframe := &LogFrame{
+		Stamp: time.Now(),
+		Dir:   dir,
+		Frame: outlog,
+	}
+	_, err := engine.Insert(logframe)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err.Error()}).Info("insert")
 	}
 }
 
@@ -220,6 +275,11 @@ func main() {
 		log.Info("xorm init error: ", err)
 	}
 
+	rsaKey, err = rsaInit(config.RsaCfg.KeyFile)
+	if err != nil {
+		log.Info("rsa init error: ", err)
+	}
+
 	address := config.TcpCfg.Ip + ":" + strconv.FormatInt(int64(config.TcpCfg.Port), 10)
 	log.Info("address port ", address)
 
@@ -276,9 +336,43 @@ func xormInit(driverName string, dataSourceName string) (*xorm.Engine, error) {
 	if err != nil {
 		return engine, err
 	}
+
+	devparam := new(term.DevParam)
+	err = engine.Sync2(devparam)
+	if err != nil {
+		return engine, err
+	}
 	return engine, err
 }
 
+//rsaInit load the platform rsa key from a PKCS#1 pem file, 未配置时生成临时密钥
+//临时密钥在重启后改变，已收到旧公钥的终端将无法解密，使用加密时应配置keyFile
+func rsaInit(keyFile string) (*rsa.PrivateKey, error) {
+	if keyFile == "" {
+		log.Warn("rsa key file is not set, generate a temporary key, terminals must exchange keys again after restart")
+		return rsa.GenerateKey(rand.Reader, proto.RSAKeyLen*8)
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data in %s", keyFile)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	//平台公钥在0x8A00中固定为128字节
+	if err = proto.CheckRSAKey(&key.PublicKey); err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	return key, nil
+}
+
 func logInit() {
 	// The API for setting attributes is a little different than the package level
 	// exported logger. See Godoc.
@@ -310,6 +404,8 @@ func httpServer() {
 		v1.POST("login", loginHandler)
 		v1.POST("config", configHandler)
 		v1.POST("control", controlHandler)
+		v1.POST("params", paramsHandler)
+		v1.POST("setparams", setParamsHandler)
 		v1.POST("userlist", userListHandler)
 		v1.POST("useradd", userAddHandler)
 	}
@@ -322,6 +418,7 @@ func httpServer() {
 	//router.LoadHTMLGlob("templates/*")
 	router.LoadHTMLFiles("frontend/dist/index.html")
 	router.GET("/", mainPage)
+	router.GET("/debug/vars", debugVarsHandler)
 
 	router.NoRoute(mainPage)
 
@@ -330,6 +427,25 @@ func httpServer() {
 	router.Run(address)
 }
 
+//运行状态，包含命令行和内存统计，需要与api相同的token
+func debugVarsHandler(c *gin.Context) {
+	tokenstr := c.GetHeader("Authorization")
+	if tokenstr == "" {
+		//说明没有token
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token"})
+		return
+	}
+	cliams, err := ParseToken(tokenstr, jwtSecKey)
+	if err != nil {
+		//返回401
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	log.Info("cliams:", cliams)
+
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
 //主页面
 func mainPage(c *gin.Context) {
 	//log.Info("no route page")
@@ -354,9 +470,15 @@ func listHandler(c *gin.Context) {
 	}
 	log.Info("cliams:", cliams)
 	type DevPageItem struct {
-		Ip    string `json:"ip"`
-		Imei  string `json:"imei"`
-		Phone string `json:"phone"`
+		Ip        string `json:"ip"`
+		Imei      string `json:"imei"`
+		Phone     string `json:"phone"`
+		Iccid     string `json:"iccid"`
+		TermModel string `json:"termmodel"`
+		HwVersion string `json:"hwversion"`
+		FwVersion string `json:"fwversion"`
+		Gnss      uint8  `json:"gnss"`
+		Comm      uint8  `json:"comm"`
 	}
 
 	type DevPageList struct {
@@ -375,6 +497,9 @@ func listHandler(c *gin.Context) {
 
 	log.Info("page:", json)
 
+	connMutex.RLock()
+	defer connMutex.RUnlock()
+
 	var devpagelist DevPageList
 	devpagelist.PageSize = 10
 	devpagelist.PageCnt = (len(connManger) + (devpagelist.PageSize - 1)) / devpagelist.PageSize
@@ -391,7 +516,16 @@ func listHandler(c *gin.Context) {
 			var item DevPageItem
 			item.Ip = val.Conn.RemoteAddr().String()
 			item.Imei = val.GetImei()
-			item.Phone = strings.TrimLeft(utils.HexBuffToString(val.GetPhone()), "0")
+			item.Phone = val.GetPhone()
+			item.Iccid = val.GetIccid()
+			//终端属性在鉴权后查询，未应答前为空
+			if attr := val.GetAttr(); attr != nil {
+				item.TermModel = attr.TermModel
+				item.HwVersion = attr.HwVersion
+				item.FwVersion = attr.FwVersion
+				item.Gnss = attr.GNSS.Raw
+				item.Comm = attr.Comm.Raw
+			}
 			datalist = append(datalist, item)
 		}
 		index++
@@ -455,7 +589,7 @@ func dataHandler(c *gin.Context) {
 
 	//获取总数
 	gpsdata := new(term.GPSData)
-	total, err := engine.Where("imei = ? AND stamp > ? AND stamp < ?", json.Imei, time.Unix(json.Start, 0), time.Unix(json.End, 0)).Count(gpsdata)
+	total, err := engine.Where("imei = ? AND datastamp > ? AND datastamp < ?", json.Imei, time.Unix(json.Start, 0), time.Unix(json.End, 0)).Count(gpsdata)
 	if err != nil {
 		log.Info("where err:", err)
 	}
@@ -475,7 +609,7 @@ func dataHandler(c *gin.Context) {
 	datas := make([]term.GPSData, 0)
 	startindex := (dataresp.PageIndex - 1) * dataresp.PageSize
 	log.Info("start:", startindex)
-	err = engine.Where("imei = ? AND stamp > ? AND stamp < ?", json.Imei, time.Unix(json.Start, 0), time.Unix(json.End, 0)).Limit(dataresp.PageSize, startindex).Find(&datas)
+	err = engine.Where("imei = ? AND datastamp > ? AND datastamp < ?", json.Imei, time.Unix(json.Start, 0), time.Unix(json.End, 0)).Asc("datastamp").Limit(dataresp.PageSize, startindex).Find(&datas)
 	if err != nil {
 		log.Info("where err:", err)
 	}
@@ -540,7 +674,8 @@ func nowGpsHandler(c *gin.Context) {
 
 	//获取总数
 	gpsdata := new(term.GPSData)
-	has, err := engine.Where("imei = ? AND state > 0", json.Imei).Desc("stamp").Limit(1).Get(gpsdata)
+	//批量补传的数据接收时间较新，按定位时间取最新位置
+	has, err := engine.Where("imei = ? AND state > 0", json.Imei).Desc("datastamp").Limit(1).Get(gpsdata)
 	if err != nil {
 		log.Info("where err:", err)
 	}
@@ -599,7 +734,7 @@ func gpsMapHandler(c *gin.Context) {
 
 	//获取总数
 	gpsmap := make([]term.GPSData, 0)
-	err = engine.Where("imei = ? AND stamp > ? AND stamp < ? AND gpsstate = ?", json.Imei, time.Unix(json.Start, 0), time.Unix(json.End, 0), 1).Asc("stamp").Find(&gpsmap)
+	err = engine.Where("imei = ? AND datastamp > ? AND datastamp < ? AND gpsstate = ?", json.Imei, time.Unix(json.Start, 0), time.Unix(json.End, 0), 1).Asc("datastamp").Find(&gpsmap)
 	if err != nil {
 		log.Info("where err:", err)
 	}
@@ -705,28 +840,188 @@ func controlHandler(c *gin.Context) {
 		return
 	}
 
-	termip := ""
-	for key, val := range connManger {
-		tempimei := val.GetImei()
-		if tempimei == json.Imei {
-			termip = key
+	cmd, ok := ctrlCmds[json.Cmd]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown cmd:" + json.Cmd})
+		return
+	}
+
+	t := findTerm(json.Imei)
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "terminal offline"})
+		return
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	result, err := t.SendCtrl(ctx, cmd, json.Param)
+	if err == term.ErrTimeout {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": 0, "result": result})
+}
+
+//ctrlCmds map the cmd of control api to the command word of 0x8105
+var ctrlCmds = map[string]uint8{
+	"upgrade":       term.CtrlUpgrade,
+	"connect":       term.CtrlConnect,
+	"poweroff":      term.CtrlPowerOff,
+	"reset":         term.CtrlReset,
+	"factory":       term.CtrlFactory,
+	"closelink":     term.CtrlCloseLink,
+	"closewireless": term.CtrlCloseWireless,
+}
+
+//requestContext bound the wait for the terminal by web.requestTimeout
+func requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(config.WebCfg.RequestTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return context.WithTimeout(c.Request.Context(), timeout)
+}
+
+//findTerm return the online terminal with imei, nil if the terminal is offline
+func findTerm(imei string) *term.Terminal {
+	connMutex.RLock()
+	defer connMutex.RUnlock()
+
+	for _, val := range connManger {
+		if val.GetImei() == imei {
+			return val
+		}
+	}
+	return nil
+}
+
+//ParamItem is one terminal parameter in the parameter api,
+//value为十进制数值或字符串，BYTE[n]参数(如0x0110~0x01FF)和未知ID的参数为十六进制的原始数据
+type ParamItem struct {
+	ID    uint32 `json:"id"`
+	Value string `json:"value"`
+}
+
+//读取终端参数，refresh为true时向在线终端查询，否则返回最近一次保存的参数
+func paramsHandler(c *gin.Context) {
+	tokenstr := c.GetHeader("Authorization")
+	if tokenstr == "" {
+		//说明没有token
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token"})
+		return
+	}
+	cliams, err := ParseToken(tokenstr, jwtSecKey)
+	if err != nil {
+		//返回401
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	log.Info("cliams:", cliams)
+
+	type DataReq struct {
+		Imei    string `json:"imei" binding:"required"`
+		Refresh bool   `json:"refresh"`
+	}
+	var json DataReq
+	if err = c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if json.Refresh {
+		t := findTerm(json.Imei)
+		if t == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "terminal offline"})
+			return
+		}
+		ctx, cancel := requestContext(c)
+		defer cancel()
+
+		if _, err = t.QueryParams(ctx); err == term.ErrTimeout {
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, term.ErrBadParam) {
+			//无法解析的参数已按十六进制保存，其余参数照常返回
+			log.WithFields(logrus.Fields{"imei": json.Imei, "error": err.Error()}).Warn("params")
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 	}
 
-	log.Info("ip:", termip)
+	params := make([]term.DevParam, 0)
+	err = engine.Where("imei = ?", json.Imei).Asc("param_id").Find(&params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	if termip != "" {
+	datalist := make([]ParamItem, 0, len(params))
+	for _, param := range params {
+		datalist = append(datalist, ParamItem{ID: param.ParamId, Value: param.Value})
+	}
+	c.JSON(http.StatusOK, gin.H{"status": 0, "data": datalist})
+}
 
-		switch json.Cmd {
-		case "reset":
-			//
-		case "factory":
-			//
+//设置在线终端的参数，返回终端应答的结果
+func setParamsHandler(c *gin.Context) {
+	tokenstr := c.GetHeader("Authorization")
+	if tokenstr == "" {
+		//说明没有token
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token"})
+		return
+	}
+	cliams, err := ParseToken(tokenstr, jwtSecKey)
+	if err != nil {
+		//返回401
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	log.Info("cliams:", cliams)
+
+	type DataReq struct {
+		Imei   string      `json:"imei" binding:"required"`
+		Params []ParamItem `json:"params" binding:"required"`
+	}
+	var json DataReq
+	if err = c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	params := make(map[uint32]string, len(json.Params))
+	for _, item := range json.Params {
+		if _, err = term.EncodeParam(item.ID, item.Value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("param 0x%04X:%s", item.ID, err.Error())})
+			return
 		}
+		params[item.ID] = item.Value
+	}
 
+	t := findTerm(json.Imei)
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "terminal offline"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": 0})
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	result, err := t.SetParams(ctx, params)
+	if err == term.ErrTimeout {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": 0, "result": result})
 }
 
 func userListHandler(c *gin.Context) {
@@ -0,0 +1,142 @@
+package term
+
+import (
+	"context"
+	"fmt"
+
+	"tsp/proto"
+)
+
+//GNSSFlags is the GNSS module attribute of the terminal
+type GNSSFlags struct {
+	GPS     bool  `bit:"0"`
+	BeiDou  bool  `bit:"1"`
+	GLONASS bool  `bit:"2"`
+	Galileo bool  `bit:"3"`
+	Raw     uint8 `bits:"all"`
+}
+
+//CommFlags is the communication module attribute of the terminal
+type CommFlags struct {
+	GPRS     bool  `bit:"0"`
+	CDMA     bool  `bit:"1"`
+	TDSCDMA  bool  `bit:"2"`
+	WCDMA    bool  `bit:"3"`
+	CDMA2000 bool  `bit:"4"`
+	TDLTE    bool  `bit:"5"`
+	Other    bool  `bit:"7"` //其他通信方式
+	Raw      uint8 `bits:"all"`
+}
+
+//AttrQueryAckBody is the reply of the terminal attribute query
+type AttrQueryAckBody struct {
+	TermType  uint16    //终端类型
+	ManufID   string    `len:"5" enc:"gbk"`
+	TermModel string    `len:"30" enc:"gbk"`
+	TermID    string    `len:"30" enc:"gbk"`
+	Iccid     string    `len:"10" enc:"bcd"`
+	HwVersion string    `prefix:"u8" enc:"gbk"`
+	FwVersion string    `prefix:"u8" enc:"gbk"`
+	GNSS      GNSSFlags `bitfield:"u8"`
+	Comm      CommFlags `bitfield:"u8"`
+}
+
+//AttrQueryAckBody2013 is the reply of the terminal attribute query of 2013 edition
+type AttrQueryAckBody2013 struct {
+	TermType  uint16
+	ManufID   string    `len:"5" enc:"gbk"`
+	TermModel string    `len:"20" enc:"gbk"`
+	TermID    string    `len:"7" enc:"gbk"`
+	Iccid     string    `len:"10" enc:"bcd"`
+	HwVersion string    `prefix:"u8" enc:"gbk"`
+	FwVersion string    `prefix:"u8" enc:"gbk"`
+	GNSS      GNSSFlags `bitfield:"u8"`
+	Comm      CommFlags `bitfield:"u8"`
+}
+
+//QueryAttr query the attribute of the terminal, 2013版本的应答转换为2019版本的结构
+func (t *Terminal) QueryAttr(ctx context.Context) (*AttrQueryAckBody, error) {
+	reply, err := t.Request(ctx, proto.AttrQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if attr := attrBody(reply.Body); attr != nil {
+		return attr, nil
+	}
+	return nil, fmt.Errorf("term: attribute query failed, result %d", reply.Result)
+}
+
+//attrBody return the attribute reply of both editions as AttrQueryAckBody, nil for other bodies
+func attrBody(body interface{}) *AttrQueryAckBody {
+	switch ack := body.(type) {
+	case *AttrQueryAckBody:
+		return ack
+	case *AttrQueryAckBody2013:
+		attr := AttrQueryAckBody(*ack)
+		return &attr
+	}
+	return nil
+}
+
+//GetAttr return the attribute of the terminal, nil before the attribute query is answered
+func (t *Terminal) GetAttr() *AttrQueryAckBody {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.attr
+}
+
+//beginAttrQuery mark the attribute query in flight, false if one is already in flight
+func (t *Terminal) beginAttrQuery() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.attrQuerying {
+		return false
+	}
+	t.attrQuerying = true
+	return true
+}
+
+//updateAttr query the attribute of the terminal and save it to dev_info table, 需先调用beginAttrQuery
+func (t *Terminal) updateAttr() {
+	attr, err := t.QueryAttr(context.Background())
+	t.mu.Lock()
+	t.attrQuerying = false
+	t.mu.Unlock()
+	if err != nil {
+		fmt.Println("query attr err:", err)
+		return
+	}
+	t.setAttr(attr)
+}
+
+//setAttr save the attribute of the terminal in memory and to dev_info table
+func (t *Terminal) setAttr(attr *AttrQueryAckBody) {
+	if attr == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.attr = attr
+	t.iccid = attr.Iccid
+	t.mu.Unlock()
+
+	if t.Engine == nil {
+		return
+	}
+
+	devinfo := &DevInfo{
+		PhoneNum:  t.GetPhone(),
+		Iccid:     attr.Iccid,
+		HwVersion: attr.HwVersion,
+		FwVersion: attr.FwVersion,
+		GnssAttr:  attr.GNSS.Raw,
+		CommAttr:  attr.Comm.Raw,
+	}
+	_, err := t.Engine.ID(devinfo.PhoneNum).Cols("iccid", "hw_version", "fw_version", "gnss_attr", "comm_attr").Update(devinfo)
+	if err != nil {
+		fmt.Println("update devinfo err:", err)
+	}
+}
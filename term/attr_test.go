@@ -0,0 +1,144 @@
+package term
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tsp/codec"
+	"tsp/proto"
+)
+
+func TestQueryAttr(t *testing.T) {
+	attr := AttrQueryAckBody{
+		TermType:  0x0003,
+		ManufID:   "MANUF",
+		TermModel: "TSP-1",
+		TermID:    "T0001",
+		Iccid:     "89860012345678901234",
+		HwVersion: "HW1.0",
+		FwVersion: "FW2.1",
+	}
+	attr.GNSS.GPS, attr.GNSS.BeiDou = true, true
+	attr.Comm.TDLTE = true
+	attr2013 := AttrQueryAckBody2013(attr)
+
+	tests := []struct {
+		name    string
+		ver2019 bool
+		body    interface{}
+	}{
+		{"2019", true, &attr},
+		{"2013", false, &attr2013},
+	}
+
+	for _, tt := range tests {
+		term, sent := pipeTerm(t, tt.ver2019)
+
+		//鉴权应答之后平台查询终端属性
+		var auth interface{} = &AuthBody2013{AuthKey: "key"}
+		if tt.ver2019 {
+			auth = &AuthBody{AuthKeyLen: 3, AuthKey: "key", Imei: "860000000000001", Version: "1.0"}
+		}
+		if sendbuff := term.Handler(upMsg(t, proto.Login, tt.ver2019, 1, auth)); len(sendbuff) != 0 {
+			t.Errorf("%s: login ack should be written by Handler:%x", tt.name, sendbuff)
+		}
+		if ack := <-sent; ack.HEADER.MID != proto.PlatAck {
+			t.Fatalf("%s: login ack:%+v", tt.name, ack.HEADER)
+		}
+		req := <-sent
+		if req.HEADER.MID != proto.AttrQuery || req.HEADER.IsVer2019() != tt.ver2019 {
+			t.Fatalf("%s: request:%+v", tt.name, req.HEADER)
+		}
+
+		//0x0107没有应答流水号，按消息ID匹配
+		if sendbuff := term.Handler(upMsg(t, proto.AttrQueryAck, tt.ver2019, 2, tt.body)); len(sendbuff) != 0 {
+			t.Errorf("%s: reply should not be answered:%x", tt.name, sendbuff)
+		}
+
+		var got *AttrQueryAckBody
+		for deadline := time.Now().Add(time.Second); got == nil && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+			got = term.GetAttr()
+		}
+		if got == nil {
+			t.Fatalf("%s: attr is not saved", tt.name)
+		}
+		if got.Iccid != attr.Iccid || got.HwVersion != attr.HwVersion || got.FwVersion != attr.FwVersion ||
+			got.TermModel != attr.TermModel || !got.GNSS.BeiDou || !got.Comm.TDLTE || got.GNSS.Raw != 0x03 {
+			t.Errorf("%s: attr:%+v", tt.name, got)
+		}
+		if term.GetIccid() != attr.Iccid {
+			t.Errorf("%s: iccid:%s", tt.name, term.GetIccid())
+		}
+
+		//QueryAttr等待中收到应答时直接返回
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		done := make(chan error, 1)
+		go func() {
+			_, err := term.QueryAttr(ctx)
+			done <- err
+		}()
+		if req = <-sent; req.HEADER.MID != proto.AttrQuery {
+			t.Fatalf("%s: request:%+v", tt.name, req.HEADER)
+		}
+		term.Handler(upMsg(t, proto.AttrQueryAck, tt.ver2019, 3, tt.body))
+		if err := <-done; err != nil {
+			t.Errorf("%s: query err:%s", tt.name, err.Error())
+		}
+		cancel()
+	}
+}
+
+func TestAttrIccidPadding(t *testing.T) {
+	data, err := codec.Marshal(&AttrQueryAckBody{Iccid: "89860012345678901234", HwVersion: "HW1", FwVersion: "FW1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//19位的ICCID末尾以F补齐
+	data[2+5+30+30+9] = 0x3F
+	var attr AttrQueryAckBody
+	if _, err = codec.Unmarshal(data, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Iccid != "8986001234567890123" || attr.FwVersion != "FW1" {
+		t.Errorf("attr:%+v", attr)
+	}
+}
+
+func TestLoginAttrQueryOnce(t *testing.T) {
+	term, sent := pipeTerm(t, true)
+	auth := &AuthBody{AuthKeyLen: 3, AuthKey: "key", Imei: "860000000000001", Version: "1.0"}
+
+	//查询未应答时重复鉴权不再查询
+	for seq := uint16(1); seq <= 2; seq++ {
+		term.Handler(upMsg(t, proto.Login, true, seq, auth))
+		if ack := <-sent; ack.HEADER.MID != proto.PlatAck {
+			t.Fatalf("login ack:%+v", ack.HEADER)
+		}
+		if seq == 1 {
+			if req := <-sent; req.HEADER.MID != proto.AttrQuery {
+				t.Fatalf("request:%+v", req.HEADER)
+			}
+		}
+	}
+	select {
+	case msg := <-sent:
+		t.Fatalf("unexpected message:%+v", msg.HEADER)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//应答之后再次鉴权重新查询
+	term.Handler(upMsg(t, proto.AttrQueryAck, true, 3, &AttrQueryAckBody{Iccid: "89860012345678901234"}))
+	for deadline := time.Now().Add(time.Second); term.GetAttr() == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	term.Handler(upMsg(t, proto.Login, true, 4, auth))
+	if ack := <-sent; ack.HEADER.MID != proto.PlatAck {
+		t.Fatalf("login ack:%+v", ack.HEADER)
+	}
+	if req := <-sent; req.HEADER.MID != proto.AttrQuery {
+		t.Fatalf("request:%+v", req.HEADER)
+	}
+}
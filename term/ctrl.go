@@ -0,0 +1,70 @@
+package term
+
+import (
+	"context"
+	"fmt"
+
+	"tsp/codec"
+	"tsp/proto"
+)
+
+//终端控制命令字
+const (
+	CtrlUpgrade       uint8 = 1 //无线升级
+	CtrlConnect       uint8 = 2 //控制终端连接指定服务器
+	CtrlPowerOff      uint8 = 3 //终端关机
+	CtrlReset         uint8 = 4 //终端复位
+	CtrlFactory       uint8 = 5 //终端恢复出厂设置
+	CtrlCloseLink     uint8 = 6 //关闭数据通信
+	CtrlCloseWireless uint8 = 7 //关闭所有无线通信
+)
+
+type CtrlBody struct {
+	Cmd   uint8
+	Param string `enc:"gbk"`
+}
+
+//PosQueryAckBody is the reply of the position query
+type PosQueryAckBody struct {
+	AckSeqNum uint16
+	Info      GPSInfoBody
+}
+
+//ReplySeq return the sequence number of the position query
+func (b *PosQueryAckBody) ReplySeq() uint16 {
+	return b.AckSeqNum
+}
+
+//SendCtrl send a terminal control command and wait for the general response,
+//返回终端应答的结果
+func (t *Terminal) SendCtrl(ctx context.Context, cmd uint8, param string) (uint8, error) {
+	if cmd < CtrlUpgrade || cmd > CtrlCloseWireless {
+		return 0, fmt.Errorf("term: unknown control command %d", cmd)
+	}
+
+	body, err := codec.Marshal(&CtrlBody{
+		Cmd:   cmd,
+		Param: param,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	reply, err := t.Request(ctx, proto.CtrlReq, body)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Result, nil
+}
+
+//QueryPosition ask the terminal for its current position
+func (t *Terminal) QueryPosition(ctx context.Context) (*GPSInfoBody, error) {
+	reply, err := t.Request(ctx, proto.PosQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ack, ok := reply.Body.(*PosQueryAckBody); ok {
+		return &ack.Info, nil
+	}
+	return nil, fmt.Errorf("term: position query failed, result %d", reply.Result)
+}
@@ -0,0 +1,301 @@
+package term
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+
+	"tsp/codec"
+	"tsp/proto"
+)
+
+//ParamType is the value type of a terminal parameter
+type ParamType uint8
+
+const (
+	ParamByte ParamType = iota + 1
+	ParamWord
+	ParamDWord
+	ParamString
+	ParamBytes //定长的原始数据，如CAN总线ID单独采集设置
+)
+
+//size return the value len of a numeric type, -1 for string and bytes
+func (typ ParamType) size() int {
+	switch typ {
+	case ParamByte:
+		return 1
+	case ParamWord:
+		return 2
+	case ParamDWord:
+		return 4
+	}
+	return -1
+}
+
+//常用终端参数ID
+const (
+	ParamHeartbeat     uint32 = 0x0001 //终端心跳发送间隔，秒
+	ParamTCPTimeout    uint32 = 0x0002 //TCP消息应答超时时间，秒
+	ParamTCPRetries    uint32 = 0x0003 //TCP消息重传次数
+	ParamAPN           uint32 = 0x0010 //主服务器APN
+	ParamServer        uint32 = 0x0013 //主服务器地址，IP或域名
+	ParamBackupServer  uint32 = 0x0017 //备份服务器地址，IP或域名
+	ParamReportTime    uint32 = 0x0029 //缺省时间汇报间隔，秒
+	ParamReportDist    uint32 = 0x002C //缺省距离汇报间隔，米
+	ParamMaxSpeed      uint32 = 0x0055 //最高速度，km/h
+	ParamOverspeedTime uint32 = 0x0056 //超速持续时间，秒
+	ParamPlateNum      uint32 = 0x0083 //机动车号牌
+	ParamPlateColor    uint32 = 0x0084 //车牌颜色
+)
+
+//paramTypes is the value type of the parameters defined by JT/T 808
+var paramTypes = map[uint32]ParamType{
+	0x0001: ParamDWord, 0x0002: ParamDWord, 0x0003: ParamDWord, 0x0004: ParamDWord,
+	0x0005: ParamDWord, 0x0006: ParamDWord, 0x0007: ParamDWord,
+	0x0010: ParamString, 0x0011: ParamString, 0x0012: ParamString, 0x0013: ParamString,
+	0x0014: ParamString, 0x0015: ParamString, 0x0016: ParamString, 0x0017: ParamString,
+	0x0018: ParamDWord, 0x0019: ParamDWord, 0x001A: ParamString, 0x001B: ParamDWord,
+	0x001C: ParamDWord, 0x001D: ParamString,
+	0x0020: ParamDWord, 0x0021: ParamDWord, 0x0022: ParamDWord,
+	0x0023: ParamString, 0x0024: ParamString, 0x0025: ParamString, 0x0026: ParamString,
+	0x0027: ParamDWord, 0x0028: ParamDWord, 0x0029: ParamDWord, 0x002C: ParamDWord,
+	0x002D: ParamDWord, 0x002E: ParamDWord, 0x002F: ParamDWord, 0x0030: ParamDWord,
+	0x0031: ParamWord, 0x0032: ParamBytes,
+	0x0040: ParamString, 0x0041: ParamString, 0x0042: ParamString, 0x0043: ParamString,
+	0x0044: ParamString, 0x0045: ParamDWord, 0x0046: ParamDWord, 0x0047: ParamDWord,
+	0x0048: ParamString, 0x0049: ParamString,
+	0x0050: ParamDWord, 0x0051: ParamDWord, 0x0052: ParamDWord, 0x0053: ParamDWord,
+	0x0054: ParamDWord, 0x0055: ParamDWord, 0x0056: ParamDWord, 0x0057: ParamDWord,
+	0x0058: ParamDWord, 0x0059: ParamDWord, 0x005A: ParamDWord, 0x005B: ParamWord,
+	0x005C: ParamWord, 0x005D: ParamWord, 0x005E: ParamWord,
+	0x0064: ParamDWord, 0x0065: ParamDWord,
+	0x0070: ParamDWord, 0x0071: ParamDWord, 0x0072: ParamDWord, 0x0073: ParamDWord,
+	0x0074: ParamDWord,
+	0x0080: ParamDWord, 0x0081: ParamWord, 0x0082: ParamWord, 0x0083: ParamString,
+	0x0084: ParamByte,
+	0x0090: ParamByte, 0x0091: ParamByte, 0x0092: ParamByte, 0x0093: ParamDWord,
+	0x0094: ParamByte, 0x0095: ParamDWord,
+	0x0100: ParamDWord, 0x0101: ParamWord, 0x0102: ParamDWord, 0x0103: ParamWord,
+}
+
+//0x0110~0x01FF为CAN总线ID单独采集设置，BYTE[8]
+const (
+	paramCANIDFirst uint32 = 0x0110
+	paramCANIDLast  uint32 = 0x01FF
+)
+
+//ParamTypeOf return the value type of a parameter, false if the id is unknown
+func ParamTypeOf(id uint32) (ParamType, bool) {
+	if id >= paramCANIDFirst && id <= paramCANIDLast {
+		return ParamBytes, true
+	}
+	typ, ok := paramTypes[id]
+	return typ, ok
+}
+
+//EncodeParam encode the value of a parameter by its type,
+//数值参数为十进制字符串(也可用0x前缀的十六进制)，STRING参数为字符串，
+//BYTE[n]参数和未知ID的参数为十六进制的原始数据，如"0a0b"
+func EncodeParam(id uint32, value string) ([]byte, error) {
+	typ, ok := ParamTypeOf(id)
+	if !ok || typ == ParamBytes {
+		return hex.DecodeString(value)
+	}
+
+	switch typ {
+	case ParamString:
+		return simplifiedchinese.GBK.NewEncoder().Bytes([]byte(value))
+	case ParamByte:
+		n, err := strconv.ParseUint(value, 0, 8)
+		return []byte{uint8(n)}, err
+	case ParamWord:
+		n, err := strconv.ParseUint(value, 0, 16)
+		return codec.Word2Bytes(uint16(n)), err
+	}
+	n, err := strconv.ParseUint(value, 0, 32)
+	return codec.Dword2Bytes(uint32(n)), err
+}
+
+//DecodeParam decode the raw value of a parameter to the string form of EncodeParam
+func DecodeParam(id uint32, raw []byte) (string, error) {
+	typ, ok := ParamTypeOf(id)
+	if !ok || typ == ParamBytes {
+		return hex.EncodeToString(raw), nil
+	}
+
+	if size := typ.size(); size > 0 && len(raw) != size {
+		return "", fmt.Errorf("param 0x%04X len %d, want %d", id, len(raw), size)
+	}
+
+	switch typ {
+	case ParamString:
+		str, err := simplifiedchinese.GBK.NewDecoder().Bytes(raw)
+		return string(str), err
+	case ParamByte:
+		return strconv.FormatUint(uint64(raw[0]), 10), nil
+	case ParamWord:
+		return strconv.FormatUint(uint64(codec.Bytes2Word(raw)), 10), nil
+	}
+	return strconv.FormatUint(uint64(codec.Bytes2DWord(raw)), 10), nil
+}
+
+//ParamItem is one parameter in the message body
+type ParamItem struct {
+	ID    uint32
+	Len   uint8
+	Value []byte `lenfield:"Len"`
+}
+
+type ParamSetBody struct {
+	Count uint8
+	Items []ParamItem `countfield:"Count"`
+}
+
+//ParamQueryAckBody is the reply of the parameter query
+type ParamQueryAckBody struct {
+	AckSeqNum uint16
+	Count     uint8
+	Items     []ParamItem `countfield:"Count"`
+}
+
+//ReplySeq return the sequence number of the parameter query
+func (b *ParamQueryAckBody) ReplySeq() uint16 {
+	return b.AckSeqNum
+}
+
+//DevParam is the last known value of a terminal parameter
+type DevParam struct {
+	PhoneNum string    `xorm:"pk notnull phone_num"`
+	ParamId  uint32    `xorm:"pk notnull param_id"`
+	Imei     string    `xorm:"imei"`
+	Value    string    `xorm:"Text value"`
+	Stamp    time.Time `xorm:"DateTime stamp"`
+}
+
+func (d DevParam) TableName() string {
+	return "dev_param"
+}
+
+//paramItems encode the parameters in the order of id
+func paramItems(params map[uint32]string) ([]ParamItem, error) {
+	ids := make([]uint32, 0, len(params))
+	for id := range params {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	items := make([]ParamItem, 0, len(ids))
+	for _, id := range ids {
+		raw, err := EncodeParam(id, params[id])
+		if err != nil {
+			return nil, fmt.Errorf("param 0x%04X:%s", id, err.Error())
+		}
+		if len(raw) > 0xFF {
+			return nil, fmt.Errorf("param 0x%04X too long", id)
+		}
+		items = append(items, ParamItem{ID: id, Len: uint8(len(raw)), Value: raw})
+	}
+	return items, nil
+}
+
+//paramValues decode the parameters to the string form of DecodeParam,
+//无法按类型解析的参数以十六进制返回，同时返回解析错误列表
+func paramValues(items []ParamItem) (map[uint32]string, []string) {
+	params := make(map[uint32]string, len(items))
+	badList := make([]string, 0)
+	for _, item := range items {
+		value, err := DecodeParam(item.ID, item.Value)
+		if err != nil {
+			badList = append(badList, err.Error())
+			value = hex.EncodeToString(item.Value)
+		}
+		params[item.ID] = value
+	}
+	return params, badList
+}
+
+//SetParams send the parameters to the terminal and wait for the general response,
+//设置成功后按查询应答相同的格式保存到dev_param表，如"0x1E"保存为"30"
+func (t *Terminal) SetParams(ctx context.Context, params map[uint32]string) (uint8, error) {
+	items, err := paramItems(params)
+	if err != nil {
+		return 0, err
+	}
+	if len(items) == 0 || len(items) > 0xFF {
+		return 0, fmt.Errorf("term: param count %d", len(items))
+	}
+
+	body, err := codec.Marshal(&ParamSetBody{Items: items})
+	if err != nil {
+		return 0, err
+	}
+
+	reply, err := t.Request(ctx, proto.ParamSet, body)
+	if err != nil {
+		return 0, err
+	}
+	if reply.Result == proto.AckSuccess {
+		values, _ := paramValues(items)
+		t.saveParams(values)
+	}
+	return reply.Result, nil
+}
+
+//ErrBadParam is returned by QueryParams when some parameters can not be decoded by their type
+var ErrBadParam = errors.New("term: bad param value")
+
+//QueryParams query all the parameters of the terminal and save them to dev_param table,
+//无法按类型解析的参数以十六进制保存，返回的错误包含这些参数的ID
+func (t *Terminal) QueryParams(ctx context.Context) (map[uint32]string, error) {
+	reply, err := t.Request(ctx, proto.ParamQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	ack, ok := reply.Body.(*ParamQueryAckBody)
+	if !ok {
+		return nil, fmt.Errorf("term: param query failed, result %d", reply.Result)
+	}
+
+	params, badList := paramValues(ack.Items)
+	t.saveParams(params)
+	if len(badList) > 0 {
+		return params, fmt.Errorf("%w: %s", ErrBadParam, strings.Join(badList, ", "))
+	}
+	return params, nil
+}
+
+//saveParams update the parameters of the terminal in dev_param table
+func (t *Terminal) saveParams(params map[uint32]string) {
+	if t.Engine == nil {
+		return
+	}
+
+	phoneNum, imei := t.GetPhone(), t.GetImei()
+	for id, value := range params {
+		param := &DevParam{
+			PhoneNum: phoneNum,
+			ParamId:  id,
+			Imei:     imei,
+			Value:    value,
+			Stamp:    time.Now(),
+		}
+
+		has, err := t.Engine.Exist(&DevParam{PhoneNum: phoneNum, ParamId: id})
+		if err == nil && has {
+			_, err = t.Engine.Where("phone_num = ? and param_id = ?", phoneNum, id).Cols("imei", "value", "stamp").Update(param)
+		} else if err == nil {
+			_, err = t.Engine.Insert(param)
+		}
+		if err != nil {
+			fmt.Println("save param err:", err)
+		}
+	}
+}
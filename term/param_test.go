@@ -0,0 +1,93 @@
+package term
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"tsp/proto"
+)
+
+func TestParam(t *testing.T) {
+	tests := []struct {
+		id    uint32
+		value string
+		raw   []byte
+	}{
+		{ParamHeartbeat, "30", []byte{0x00, 0x00, 0x00, 0x1E}},
+		{0x0031, "500", []byte{0x01, 0xF4}},
+		{ParamPlateColor, "2", []byte{0x02}},
+		{0x0090, "1", []byte{0x01}},
+		{0x0101, "60", []byte{0x00, 0x3C}},
+		{ParamServer, "tsp.example.com", []byte("tsp.example.com")},
+		{ParamPlateNum, "京A12345", []byte{0xBE, 0xA9, 'A', '1', '2', '3', '4', '5'}},
+		{0x0110, "0102030405060708", []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{0xF001, "0a0b", []byte{0x0A, 0x0B}},
+	}
+
+	for _, tt := range tests {
+		raw, err := EncodeParam(tt.id, tt.value)
+		if err != nil || !bytes.Equal(raw, tt.raw) {
+			t.Errorf("encode 0x%04X:%x, err:%v", tt.id, raw, err)
+		}
+		value, err := DecodeParam(tt.id, tt.raw)
+		if err != nil || value != tt.value {
+			t.Errorf("decode 0x%04X:%s, err:%v", tt.id, value, err)
+		}
+	}
+
+	if _, err := EncodeParam(ParamPlateColor, "256"); err == nil {
+		t.Errorf("byte param out of range should fail")
+	}
+	if _, err := DecodeParam(ParamHeartbeat, []byte{0x1E}); err == nil {
+		t.Errorf("short dword param should fail")
+	}
+}
+
+func TestParamValues(t *testing.T) {
+	//设置的值按查询应答的格式保存
+	items, err := paramItems(map[uint32]string{ParamHeartbeat: "0x1E", 0xF001: "0A0B", ParamServer: "tsp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, badList := paramValues(items)
+	want := map[uint32]string{ParamHeartbeat: "30", 0xF001: "0a0b", ParamServer: "tsp"}
+	if !reflect.DeepEqual(params, want) || len(badList) != 0 {
+		t.Errorf("params:%v, bad:%v", params, badList)
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	term, sent := pipeTerm(t, true)
+
+	type result struct {
+		params map[uint32]string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		params, err := term.QueryParams(context.Background())
+		done <- result{params, err}
+	}()
+
+	req := <-sent
+	term.Handler(upMsg(t, proto.ParamQueryAck, true, 1, &ParamQueryAckBody{
+		AckSeqNum: req.HEADER.SeqNum,
+		Count:     2,
+		Items: []ParamItem{
+			{ID: ParamHeartbeat, Len: 4, Value: []byte{0x00, 0x00, 0x00, 0x1E}},
+			{ID: ParamMaxSpeed, Len: 2, Value: []byte{0x00, 0x78}},
+		},
+	}))
+
+	//长度错误的参数以十六进制返回，同时返回ErrBadParam
+	r := <-done
+	if !errors.Is(r.err, ErrBadParam) {
+		t.Errorf("err:%v", r.err)
+	}
+	if r.params[ParamHeartbeat] != "30" || r.params[ParamMaxSpeed] != "0078" {
+		t.Errorf("params:%v", r.params)
+	}
+}
@@ -0,0 +1,203 @@
+package term
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tsp/proto"
+)
+
+//应答超时与重传的默认值，第n+1次的超时时间T(n+1)=T(n)*(n+1)，
+//Terminal的AckTimeout和AckRetries为0时使用
+var (
+	//DefaultAckTimeout is the timeout of the first transmission
+	DefaultAckTimeout = 10 * time.Second
+	//DefaultAckRetries is how many times a request is retransmitted before ErrTimeout
+	DefaultAckRetries = 3
+)
+
+//ErrTimeout is returned when the terminal does not answer in time
+var ErrTimeout = errors.New("term: wait response timeout")
+
+//ErrClosed is returned to the pending requests when the connection is closed
+var ErrClosed = errors.New("term: connection closed")
+
+//Reply is the answer of the terminal to a platform request
+type Reply struct {
+	MID    uint16      //应答的消息ID
+	Result uint8       //通用应答的结果，专用应答为AckSuccess
+	Body   interface{} //应答消息体
+}
+
+//replyTo map a specific reply to the request it answers
+var replyTo = map[uint16]uint16{
+	proto.AttrQueryAck:  proto.AttrQuery,
+	proto.ParamQueryAck: proto.ParamQuery,
+	proto.PosQueryAck:   proto.PosQuery,
+}
+
+//seqReply is a specific reply body that carry the sequence number of the request
+type seqReply interface {
+	ReplySeq() uint16
+}
+
+//requestKey identify a request by message id and platform sequence number
+type requestKey struct {
+	mid    uint16
+	seqNum uint16
+}
+
+type pendingRequest struct {
+	order uint64 //发送顺序，应答不带流水号时匹配最早的请求
+	reply chan Reply
+}
+
+//nextSeq reserve count platform sequence numbers and return the first one,
+//平台流水号独立于终端流水号，从0开始递增，超过0xFFFF后回到0
+func (t *Terminal) nextSeq(count int) uint16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seq := t.platSeq
+	t.platSeq += uint16(count)
+	return seq
+}
+
+func (t *Terminal) addPending(key requestKey) chan Reply {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending == nil {
+		t.pending = make(map[requestKey]*pendingRequest)
+	}
+	t.sent++
+	p := &pendingRequest{order: t.sent, reply: make(chan Reply, 1)}
+	t.pending[key] = p
+	return p.reply
+}
+
+func (t *Terminal) removePending(key requestKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, key)
+}
+
+//resolve pass a reply to the request it answers, return false if no request wait for it
+func (t *Terminal) resolve(mid uint16, body interface{}) bool {
+	reply := Reply{MID: mid, Result: proto.AckSuccess, Body: body}
+
+	var key requestKey
+	seqKnown := true
+	if ack, ok := body.(*TermAckBody); ok {
+		key = requestKey{mid: ack.AckID, seqNum: ack.AckSeqNum}
+		reply.Result = ack.AckResult
+	} else if req, ok := replyTo[mid]; ok {
+		key.mid = req
+		if r, ok := body.(seqReply); ok {
+			key.seqNum = r.ReplySeq()
+		} else {
+			seqKnown = false
+		}
+	} else {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !seqKnown {
+		//应答不带流水号，取最早发送的同类请求
+		found := false
+		var oldest uint64
+		for k, p := range t.pending {
+			if k.mid == key.mid && (!found || p.order < oldest) {
+				key, oldest, found = k, p.order, true
+			}
+		}
+	}
+
+	p, ok := t.pending[key]
+	if !ok {
+		return false
+	}
+	delete(t.pending, key)
+	p.reply <- reply
+	return true
+}
+
+//Close fail all the pending requests, it should be called when the connection is closed
+func (t *Terminal) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, p := range t.pending {
+		close(p.reply)
+		delete(t.pending, key)
+	}
+	t.closed = true
+}
+
+//write send a frame to the terminal
+func (t *Terminal) write(data []byte) error {
+	if t.OnWrite != nil {
+		t.OnWrite(data)
+	}
+	_, err := t.Conn.Write(data)
+	return err
+}
+
+//Request send a message with a new platform sequence number and wait for the reply,
+//超时未应答时按T(n+1)=T(n)*(n+1)重传，重传使用相同的流水号。
+//ctx到期时不再等待，返回ErrTimeout
+func (t *Terminal) Request(ctx context.Context, mid uint16, body []byte) (Reply, error) {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return Reply{}, ErrClosed
+	}
+
+	frame, seq := t.packSeq(t.makeMsg(mid, body))
+	if len(frame) == 0 {
+		return Reply{}, errors.New("term: pack message failed")
+	}
+	key := requestKey{mid: mid, seqNum: seq}
+
+	ch := t.addPending(key)
+	defer t.removePending(key)
+
+	timeout, retries := t.AckTimeout, t.AckRetries
+	if timeout <= 0 {
+		timeout = DefaultAckTimeout
+	}
+	if retries <= 0 {
+		retries = DefaultAckRetries
+	}
+
+	for n := 1; n <= retries+1; n++ {
+		if err := t.write(frame); err != nil {
+			return Reply{}, err
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case reply, ok := <-ch:
+			timer.Stop()
+			if !ok {
+				return Reply{}, ErrClosed
+			}
+			return reply, nil
+		case <-ctx.Done():
+			timer.Stop()
+			if ctx.Err() == context.DeadlineExceeded {
+				return Reply{}, ErrTimeout
+			}
+			return Reply{}, ctx.Err()
+		case <-timer.C:
+		}
+		timeout = timeout * time.Duration(n+1)
+	}
+	return Reply{}, ErrTimeout
+}
@@ -0,0 +1,210 @@
+package term
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tsp/proto"
+)
+
+func TestRequestReply(t *testing.T) {
+	attr := &AttrQueryAckBody{Iccid: "89860012345678901234", HwVersion: "HW1", FwVersion: "FW1"}
+
+	tests := []struct {
+		name string
+		mid  uint16
+		//reply make the reply to the request, nil表示不应答
+		reply func(req proto.Message) (uint16, interface{})
+		want  uint8
+		err   error
+	}{
+		{
+			name: "general response",
+			mid:  proto.CtrlReq,
+			reply: func(req proto.Message) (uint16, interface{}) {
+				return proto.TermAck, &TermAckBody{AckSeqNum: req.HEADER.SeqNum, AckID: req.HEADER.MID, AckResult: proto.AckFail}
+			},
+			want: proto.AckFail,
+		},
+		{
+			name: "general response of other seq",
+			mid:  proto.CtrlReq,
+			reply: func(req proto.Message) (uint16, interface{}) {
+				return proto.TermAck, &TermAckBody{AckSeqNum: req.HEADER.SeqNum + 1, AckID: req.HEADER.MID}
+			},
+			err: ErrTimeout,
+		},
+		{
+			name: "general response of other message",
+			mid:  proto.CtrlReq,
+			reply: func(req proto.Message) (uint16, interface{}) {
+				return proto.TermAck, &TermAckBody{AckSeqNum: req.HEADER.SeqNum, AckID: proto.ParamSet}
+			},
+			err: ErrTimeout,
+		},
+		{
+			name: "specific reply with seq",
+			mid:  proto.ParamQuery,
+			reply: func(req proto.Message) (uint16, interface{}) {
+				return proto.ParamQueryAck, &ParamQueryAckBody{AckSeqNum: req.HEADER.SeqNum}
+			},
+			want: proto.AckSuccess,
+		},
+		{
+			name: "specific reply of other seq",
+			mid:  proto.ParamQuery,
+			reply: func(req proto.Message) (uint16, interface{}) {
+				return proto.ParamQueryAck, &ParamQueryAckBody{AckSeqNum: req.HEADER.SeqNum - 1}
+			},
+			err: ErrTimeout,
+		},
+		{
+			name: "specific reply without seq",
+			mid:  proto.AttrQuery,
+			reply: func(req proto.Message) (uint16, interface{}) {
+				return proto.AttrQueryAck, attr
+			},
+			want: proto.AckSuccess,
+		},
+	}
+
+	for _, tt := range tests {
+		term, sent := pipeTerm(t, true)
+		term.AckRetries = 1
+
+		type result struct {
+			reply Reply
+			err   error
+		}
+		done := make(chan result, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			reply, err := term.Request(ctx, tt.mid, nil)
+			done <- result{reply, err}
+		}()
+
+		req := <-sent
+		if req.HEADER.MID != tt.mid {
+			t.Fatalf("%s: request:%+v", tt.name, req.HEADER)
+		}
+		mid, body := tt.reply(req)
+		term.Handler(upMsg(t, mid, true, 1, body))
+
+		r := <-done
+		if r.err != tt.err {
+			t.Errorf("%s: err:%v, want:%v", tt.name, r.err, tt.err)
+			continue
+		}
+		if tt.err == nil && (r.reply.MID != mid || r.reply.Result != tt.want) {
+			t.Errorf("%s: reply:%+v", tt.name, r.reply)
+		}
+	}
+}
+
+func TestRequestOrder(t *testing.T) {
+	term, sent := pipeTerm(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	//两个请求同时等待，带流水号的应答按流水号匹配，不带流水号的应答匹配最早的请求
+	replies := make([]chan Reply, 4)
+	reqs := make([]proto.Message, 4)
+	for i, mid := range []uint16{proto.ParamQuery, proto.ParamQuery, proto.AttrQuery, proto.AttrQuery} {
+		replies[i] = make(chan Reply, 1)
+		go func(mid uint16, ch chan Reply) {
+			reply, err := term.Request(ctx, mid, nil)
+			if err != nil {
+				t.Errorf("mid:0x%04X err:%s", mid, err.Error())
+			}
+			ch <- reply
+		}(mid, replies[i])
+		reqs[i] = <-sent
+	}
+
+	term.Handler(upMsg(t, proto.ParamQueryAck, true, 1, &ParamQueryAckBody{AckSeqNum: reqs[1].HEADER.SeqNum, Count: 1,
+		Items: []ParamItem{{ID: ParamHeartbeat, Len: 4, Value: []byte{0, 0, 0, 30}}}}))
+	term.Handler(upMsg(t, proto.ParamQueryAck, true, 2, &ParamQueryAckBody{AckSeqNum: reqs[0].HEADER.SeqNum}))
+	term.Handler(upMsg(t, proto.AttrQueryAck, true, 3, &AttrQueryAckBody{HwVersion: "first"}))
+	term.Handler(upMsg(t, proto.AttrQueryAck, true, 4, &AttrQueryAckBody{HwVersion: "second"}))
+
+	if body := (<-replies[0]).Body.(*ParamQueryAckBody); body.Count != 0 {
+		t.Errorf("first param reply:%+v", body)
+	}
+	if body := (<-replies[1]).Body.(*ParamQueryAckBody); body.Count != 1 {
+		t.Errorf("second param reply:%+v", body)
+	}
+	if body := (<-replies[2]).Body.(*AttrQueryAckBody); body.HwVersion != "first" {
+		t.Errorf("first attr reply:%+v", body)
+	}
+	if body := (<-replies[3]).Body.(*AttrQueryAckBody); body.HwVersion != "second" {
+		t.Errorf("second attr reply:%+v", body)
+	}
+}
+
+func TestRequestRetransmit(t *testing.T) {
+	term, sent := pipeTerm(t, true)
+	term.AckTimeout = 20 * time.Millisecond
+	term.AckRetries = 3
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := term.Request(context.Background(), proto.CtrlReq, []byte{CtrlReset})
+		done <- err
+	}()
+
+	//T(n+1)=T(n)*(n+1)，每次重传前等待20ms、40ms、120ms，最后等待480ms
+	wants := []time.Duration{0, 20, 60, 180}
+	var seqNum uint16
+	for i, want := range wants {
+		req := <-sent
+		elapsed := time.Since(start)
+		if i == 0 {
+			seqNum = req.HEADER.SeqNum
+		} else if req.HEADER.SeqNum != seqNum {
+			t.Errorf("transmission:%d seq:%d, want:%d", i, req.HEADER.SeqNum, seqNum)
+		}
+		if elapsed < want*time.Millisecond {
+			t.Errorf("transmission:%d at %v, want after %dms", i, elapsed, want)
+		}
+	}
+
+	if err := <-done; err != ErrTimeout {
+		t.Errorf("err:%v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 660*time.Millisecond {
+		t.Errorf("timeout after %v, want after 660ms", elapsed)
+	}
+	select {
+	case req := <-sent:
+		t.Errorf("unexpected transmission:%+v", req.HEADER)
+	default:
+	}
+
+	//下一个请求使用新的流水号
+	go term.Request(context.Background(), proto.CtrlReq, []byte{CtrlReset})
+	if req := <-sent; req.HEADER.SeqNum != seqNum+1 {
+		t.Errorf("next seq:%d, want:%d", req.HEADER.SeqNum, seqNum+1)
+	}
+}
+
+func TestRequestClose(t *testing.T) {
+	term, sent := pipeTerm(t, true)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := term.Request(context.Background(), proto.CtrlReq, []byte{CtrlReset})
+		done <- err
+	}()
+	<-sent
+
+	term.Close()
+	if err := <-done; err != ErrClosed {
+		t.Errorf("pending err:%v", err)
+	}
+	if _, err := term.Request(context.Background(), proto.CtrlReq, []byte{CtrlReset}); err != ErrClosed {
+		t.Errorf("closed err:%v", err)
+	}
+}
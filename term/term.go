@@ -1,15 +1,18 @@
 package term
 
 import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"math/big"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"tsp/codec"
 	"tsp/proto"
-	"tsp/utils"
 
 	"github.com/go-xorm/xorm"
 	_ "github.com/lib/pq"
@@ -27,15 +30,22 @@ type DevInfo struct {
 	TermId     string `xorm:"term_id"`
 	PlateColor int    `xorm:"plate_color"`
 	PlateNum   string `xorm:"plate_num"`
+	Iccid      string `xorm:"iccid"`
+	HwVersion  string `xorm:"hw_version"`
+	FwVersion  string `xorm:"fw_version"`
+	GnssAttr   uint8  `xorm:"gnss_attr"`
+	CommAttr   uint8  `xorm:"comm_attr"`
 }
 
 func (d DevInfo) TableName() string {
 	return "dev_info"
 }
 
+//GPSData is a location record, Stamp为平台接收时间，DataStamp为终端上报的定位时间
+//批量上传的各个位置点接收时间相同，按时间查询和排序使用DataStamp
 type GPSData struct {
-	Imei      string    `xorm:"pk notnull imei`
-	Stamp     time.Time `xorm:"DateTime pk notnull stamp`
+	Imei      string    `xorm:"pk notnull imei"`
+	Stamp     time.Time `xorm:"DateTime pk notnull stamp"`
 	WarnFlag  uint32    `xorm:"warnflag"`
 	State     uint32    `xorm:"state"`
 	AccState  uint8     `xorm:"accstate"`
@@ -45,7 +55,15 @@ type GPSData struct {
 	Altitude  uint16    `xorm:"altitude"`
 	Speed     uint16    `xorm:"speed"`
 	Direction uint16    `xorm:"direction"`
-	DataStamp time.Time `xorm:"DateTime pk notnull datastamp`
+	DataStamp time.Time `xorm:"DateTime pk notnull datastamp"`
+	LoadState uint8     `xorm:"loadstate"`
+	OilCut    uint8     `xorm:"oilcut"`
+	DoorLock  uint8     `xorm:"doorlock"`
+	Mileage   uint32    `xorm:"mileage"`
+	Fuel      uint16    `xorm:"fuel"`
+	Signal    uint8     `xorm:"signal"`
+	Satellite uint8     `xorm:"satellite"`
+	Extra     string    `xorm:"Text extra"` //未解析的附加信息，十六进制
 }
 
 func (d GPSData) TableName() string {
@@ -59,15 +77,30 @@ type Terminal struct {
 	vin       string
 	tboxver   string
 	loginTime time.Time
-	seqNum    uint16
-	phoneNum  []byte
+	verFlag   byte
+	version   uint8
+	phoneNum  string
+	assembler *proto.Assembler
+	pubKey    *rsa.PublicKey
+	encrypt   bool
+	keySent   bool
 	Conn      net.Conn
 	Engine    *xorm.Engine
-	Ch        chan int
-}
-
-func (t *Terminal) NewTerminal() {
-	t.Ch = make(chan int)
+	RSAKey    *rsa.PrivateKey
+	//OnWrite is called with every frame the platform send by itself, 可用于记录日志
+	OnWrite func(data []byte)
+	//AckTimeout and AckRetries control the retransmission of Request, 为0时使用默认值
+	AckTimeout time.Duration
+	AckRetries int
+
+	mu      sync.Mutex
+	platSeq uint16
+	sent    uint64
+	pending map[requestKey]*pendingRequest
+	closed  bool
+	attr    *AttrQueryAckBody
+	//终端属性查询进行中，重复鉴权时不再发起查询
+	attrQuerying bool
 }
 
 type TermAckBody struct {
@@ -85,11 +118,22 @@ type PlatAckBody struct {
 type RegisterBody struct {
 	ProID         uint16
 	CityID        uint16
-	ManufID       []byte `len:"11"`
-	TermType      []byte `len:"30"`
-	TermID        []byte `len:"30"`
+	ManufID       string `len:"11" enc:"gbk"`
+	TermType      string `len:"30" enc:"gbk"`
+	TermID        string `len:"30" enc:"gbk"`
 	LicPlateColor uint8
-	LicPlate      string
+	LicPlate      string `enc:"gbk"`
+}
+
+//RegisterBody2013 is the register body of 2013 edition
+type RegisterBody2013 struct {
+	ProID         uint16
+	CityID        uint16
+	ManufID       string `len:"5" enc:"gbk"`
+	TermType      string `len:"20" enc:"gbk"`
+	TermID        string `len:"7" enc:"gbk"`
+	LicPlateColor uint8
+	LicPlate      string `enc:"gbk"`
 }
 
 type RegisterAckBody struct {
@@ -100,107 +144,530 @@ type RegisterAckBody struct {
 
 type AuthBody struct {
 	AuthKeyLen uint8
-	AuthKey    string
-	Imei       []byte `len:"15"`
-	Version    []byte `len:"20"`
+	AuthKey    string `lenfield:"AuthKeyLen"`
+	Imei       string `len:"15" enc:"gbk"`
+	Version    string `len:"20" enc:"gbk"`
+}
+
+//AuthBody2013 is the login body of 2013 edition
+type AuthBody2013 struct {
+	AuthKey string
 }
 
 type GPSInfoBody struct {
-	WarnFlag uint32
-	State    uint32
-	Lat      uint32
-	Lng      uint32
+	WarnFlag AlarmFlags  `bitfield:"u32"`
+	State    StatusFlags `bitfield:"u32"`
+	Lat      Coordinate
+	Lng      Coordinate
 	Alt      uint16
 	Speed    uint16
 	Dir      uint16
-	Time     []byte `len:"6"`
+	Time     codec.BCDTime
+	Extra    GPSExtra `tlv:"u8,u8"`
 }
 
-type CtrlBody struct {
-	Cmd   uint8
-	Param string
+//AlarmFlags is the alarm word of a location report
+type AlarmFlags struct {
+	Emergency       bool   `bit:"0"`  //紧急报警
+	Overspeed       bool   `bit:"1"`  //超速报警
+	Fatigue         bool   `bit:"2"`  //疲劳驾驶报警
+	Danger          bool   `bit:"3"`  //危险驾驶行为报警
+	GNSSFault       bool   `bit:"4"`  //GNSS模块发生故障
+	GNSSAntennaCut  bool   `bit:"5"`  //GNSS天线未接或被剪断
+	GNSSShort       bool   `bit:"6"`  //GNSS天线短路
+	PowerLow        bool   `bit:"7"`  //终端主电源欠压
+	PowerOff        bool   `bit:"8"`  //终端主电源掉电
+	LCDFault        bool   `bit:"9"`  //终端LCD或显示器故障
+	TTSFault        bool   `bit:"10"` //TTS模块故障
+	CameraFault     bool   `bit:"11"` //摄像头故障
+	ICCardFault     bool   `bit:"12"` //道路运输证IC卡模块故障
+	OverspeedWarn   bool   `bit:"13"` //超速预警
+	FatigueWarn     bool   `bit:"14"` //疲劳驾驶预警
+	IllegalDriving  bool   `bit:"15"` //违规行驶报警
+	TirePressure    bool   `bit:"16"` //胎压预警
+	RightBlindSpot  bool   `bit:"17"` //右转盲区异常报警
+	DriveTimeout    bool   `bit:"18"` //当天累计驾驶超时
+	ParkTimeout     bool   `bit:"19"` //超时停车
+	InOutArea       bool   `bit:"20"` //进出区域
+	InOutRoute      bool   `bit:"21"` //进出路线
+	RouteTime       bool   `bit:"22"` //路段行驶时间不足/过长
+	RouteDeviate    bool   `bit:"23"` //路线偏离报警
+	VSSFault        bool   `bit:"24"` //车辆VSS故障
+	FuelAbnormal    bool   `bit:"25"` //车辆油量异常
+	Stolen          bool   `bit:"26"` //车辆被盗
+	IllegalIgnition bool   `bit:"27"` //车辆非法点火
+	IllegalMove     bool   `bit:"28"` //车辆非法位移
+	Collision       bool   `bit:"29"` //碰撞侧翻报警
+	Rollover        bool   `bit:"30"` //侧翻预警
+	IllegalDoor     bool   `bit:"31"` //非法开门报警
+	Raw             uint32 `bits:"all"`
 }
 
-func (t *Terminal) SendCtrl(cmdid uint8, param string) error {
-	var err error
-	var body []byte
-	body, err = codec.Marshal(&CtrlBody{
-		Cmd:   cmdid,
-		Param: param,
-	})
-	if err != nil {
-		fmt.Println("err:", err)
+//载重状态
+const (
+	LoadEmpty uint8 = 0
+	LoadHalf  uint8 = 1
+	LoadFull  uint8 = 3
+)
+
+//StatusFlags is the status word of a location report
+type StatusFlags struct {
+	ACC              bool   `bit:"0"`    //ACC开
+	Fixed            bool   `bit:"1"`    //已定位
+	South            bool   `bit:"2"`    //南纬
+	West             bool   `bit:"3"`    //西经
+	Stopped          bool   `bit:"4"`    //停运状态
+	Encrypted        bool   `bit:"5"`    //经纬度已经保密插件加密
+	ForwardCollision bool   `bit:"6"`    //紧急刹车系统采集的前撞预警
+	LaneDeparture    bool   `bit:"7"`    //车道偏移预警
+	Load             uint8  `bits:"8-9"` //载重状态
+	OilCut           bool   `bit:"10"`   //车辆油路断开
+	CircuitCut       bool   `bit:"11"`   //车辆电路断开
+	DoorLocked       bool   `bit:"12"`   //车门加锁
+	Door1            bool   `bit:"13"`   //前门开
+	Door2            bool   `bit:"14"`   //中门开
+	Door3            bool   `bit:"15"`   //后门开
+	Door4            bool   `bit:"16"`   //驾驶席门开
+	Door5            bool   `bit:"17"`   //自定义门开
+	GPS              bool   `bit:"18"`   //使用GPS卫星定位
+	BeiDou           bool   `bit:"19"`   //使用北斗卫星定位
+	GLONASS          bool   `bit:"20"`   //使用GLONASS卫星定位
+	Galileo          bool   `bit:"21"`   //使用Galileo卫星定位
+	Moving           bool   `bit:"22"`   //车辆处于行驶状态
+	Raw              uint32 `bits:"all"`
+}
+
+//Coordinate is a latitude or longitude in degrees, sent as uint32 in 1e-6 degree
+type Coordinate float64
+
+func (c Coordinate) MarshalJT808() ([]byte, error) {
+	return codec.Dword2Bytes(c.Micro()), nil
+}
+
+func (c *Coordinate) UnmarshalJT808(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, fmt.Errorf("data to short")
 	}
+	*c = Coordinate(float64(codec.Bytes2DWord(data)) / 1e6)
+	return 4, nil
+}
 
-	msg := proto.Message{
-		HEADER: proto.Header{
-			MID:      proto.CtrlReq,
-			Attr:     proto.MakeAttr(1, false, 0, uint16(len(body))),
-			Version:  1,
-			PhoneNum: string(t.phoneNum),
-			SeqNum:   t.seqNum,
-		},
-		BODY: body,
+func (c Coordinate) SizeJT808() int {
+	return 4
+}
+
+//Micro return the coordinate in 1e-6 degree
+func (c Coordinate) Micro() uint32 {
+	return uint32(math.Round(float64(c) * 1e6))
+}
+
+//GPSExtra is the additional information items of a location report
+type GPSExtra struct {
+	Mileage   *uint32          `tlvid:"0x01"` //里程，1/10km
+	Fuel      *uint16          `tlvid:"0x02"` //油量，1/10L
+	Speed     *uint16          `tlvid:"0x03"` //行驶记录功能获取的速度，1/10km/h
+	AlarmID   *uint16          `tlvid:"0x04"` //需要人工确认报警事件的ID
+	Signal    *uint8           `tlvid:"0x30"` //无线通信网络信号强度
+	Satellite *uint8           `tlvid:"0x31"` //GNSS定位卫星数
+	Other     map[uint8][]byte `tlvid:"*"`
+}
+
+//BatchGPSBody is the body of 0x0704, Type 0:正常位置批量汇报 1:盲区补报
+type BatchGPSBody struct {
+	Count uint16
+	Type  uint8
+	Items []BatchGPSItem `countfield:"Count"`
+}
+
+type BatchGPSItem struct {
+	Info GPSInfoBody `prefix:"u16"`
+}
+
+type RSAKeyBody struct {
+	E uint32
+	N []byte `len:"128"`
+}
+
+func init() {
+	msgTypes := []proto.MsgType{
+		{ID: proto.TermAck, Name: "终端通用应答", Dir: proto.DirUp, Body: &TermAckBody{}},
+		{ID: proto.Heartbeat, Name: "终端心跳", Dir: proto.DirUp},
+		{ID: proto.Unregister, Name: "终端注销", Dir: proto.DirUp},
+		{ID: proto.Register, Name: "终端注册", Dir: proto.DirUp, Body: &RegisterBody{}, Body2013: &RegisterBody2013{}},
+		{ID: proto.Login, Name: "终端鉴权", Dir: proto.DirUp, Body: &AuthBody{}, Body2013: &AuthBody2013{}},
+		{ID: proto.Gpsinfo, Name: "位置信息汇报", Dir: proto.DirUp, Body: &GPSInfoBody{}},
+		{ID: proto.BatchGps, Name: "定位数据批量上传", Dir: proto.DirUp, Body: &BatchGPSBody{}},
+		{ID: proto.TermRSA, Name: "终端RSA公钥", Dir: proto.DirUp, Body: &RSAKeyBody{}},
+		{ID: proto.PlatAck, Name: "平台通用应答", Dir: proto.DirDown, Body: &PlatAckBody{}},
+		{ID: proto.RetransReq, Name: "补传分包请求", Dir: proto.DirDown},
+		{ID: proto.RegisterAck, Name: "终端注册应答", Dir: proto.DirDown, Body: &RegisterAckBody{}},
+		{ID: proto.CtrlReq, Name: "终端控制", Dir: proto.DirDown, Body: &CtrlBody{}},
+		{ID: proto.ParamSet, Name: "设置终端参数", Dir: proto.DirDown, Body: &ParamSetBody{}},
+		{ID: proto.ParamQuery, Name: "查询终端参数", Dir: proto.DirDown},
+		{ID: proto.ParamQueryAck, Name: "查询终端参数应答", Dir: proto.DirUp, Body: &ParamQueryAckBody{}},
+		{ID: proto.AttrQuery, Name: "查询终端属性", Dir: proto.DirDown},
+		{ID: proto.AttrQueryAck, Name: "查询终端属性应答", Dir: proto.DirUp, Body: &AttrQueryAckBody{}, Body2013: &AttrQueryAckBody2013{}},
+		{ID: proto.PosQuery, Name: "位置信息查询", Dir: proto.DirDown},
+		{ID: proto.PosQueryAck, Name: "位置信息查询应答", Dir: proto.DirUp, Body: &PosQueryAckBody{}},
+		{ID: proto.UpdateReq, Name: "下发终端升级包", Dir: proto.DirDown},
+		{ID: proto.PlatRSA, Name: "平台RSA公钥", Dir: proto.DirDown, Body: &RSAKeyBody{}},
+	}
+
+	for _, mt := range msgTypes {
+		proto.RegisterMsg(mt)
 	}
-	sendbuff := proto.Packer(msg)
-	t.Conn.Write(sendbuff)
+}
 
-	select {
-	case num := <-t.Ch:
-		fmt.Println("num:", num)
-	case <-time.After(3 * time.Second):
-		fmt.Println("timeout")
+//SendRSAKey send the platform public key to the terminal, the terminal will reply with its public key
+func (t *Terminal) SendRSAKey() error {
+	if t.RSAKey == nil {
+		return proto.ErrNoPlatRSAKey
 	}
 
-	return nil
+	sendbuff, err := t.platKey()
+	if err != nil {
+		return err
+	}
+
+	return t.write(sendbuff)
+}
+
+//platKey pack the PlatRSA message with the platform public key, 密钥交换消息不加密
+func (t *Terminal) platKey() ([]byte, error) {
+	body, err := codec.Marshal(&RSAKeyBody{
+		E: uint32(t.RSAKey.PublicKey.E),
+		N: t.RSAKey.PublicKey.N.Bytes(),
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+
+	t.mu.Lock()
+	t.keySent = true
+	t.mu.Unlock()
+
+	frame, _ := t.packPlain(t.makeMsg(proto.PlatRSA, body))
+	return frame, nil
 }
 
 func (t *Terminal) GetImei() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	return t.imei
 }
 
 func (t *Terminal) GetIccid() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	return t.iccid
 }
 
-func (t *Terminal) GetPhone() []byte {
+func (t *Terminal) GetPhone() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	return t.phoneNum
 }
 
 //Handler is proto Handler api
+//终端信息可能被发送请求的其他goroutine读取，修改时需持有mu
 func (t *Terminal) Handler(msg proto.Message) []byte {
-	if t.phoneNum == nil {
-		t.phoneNum = make([]byte, 10)
+	t.mu.Lock()
+	t.phoneNum = msg.HEADER.PhoneNum
+
+	//记录终端使用的协议版本，应答时保持一致
+	if msg.HEADER.IsVer2019() {
+		t.verFlag = 1
+	} else {
+		t.verFlag = 0
+	}
+	t.version = msg.HEADER.Version
+
+	if t.assembler == nil {
+		t.assembler = proto.NewAssembler(proto.AssembleTimeout, proto.AssembleRetry)
+	}
+	full, ok, err := t.assembler.Push(msg)
+	t.mu.Unlock()
+
+	if err != nil {
+		fmt.Println("err:", err)
+		return t.platAck(msg, proto.AckResult(err))
+	}
+	//未收齐的分包逐包应答
+	if !ok {
+		return t.platAck(msg, proto.AckSuccess)
+	}
+	//收齐的消息按最后收到的分包的流水号应答，之前的分包已逐包应答
+	if msg.HEADER.IsMulti() {
+		full.HEADER.SeqNum = msg.HEADER.SeqNum
+	}
+	return t.handleMsg(full)
+}
+
+//CheckLost request the terminal to retransmit the sub packets missing longer than AssembleTimeout,
+//连接空闲时也需要检查，由定时器周期调用
+func (t *Terminal) CheckLost(now time.Time) {
+	t.mu.Lock()
+	var lostList []proto.Lost
+	if t.assembler != nil {
+		lostList = t.assembler.Check(now)
+	}
+	t.mu.Unlock()
+
+	for _, lost := range lostList {
+		body := proto.RetransBody(lost)
+		if err := t.write(t.pack(t.makeMsg(proto.RetransReq, body))); err != nil {
+			fmt.Println("err:", err)
+			return
+		}
+	}
+}
+
+//ErrorAck make the general response for a corrupt frame from the terminal
+//帧头无法解析或终端尚未发送过有效消息时返回nil
+func (t *Terminal) ErrorAck(ferr *proto.FrameError) []byte {
+	if ferr.Header == nil || len(t.phoneNum) == 0 {
+		return nil
+	}
+
+	return t.platAck(proto.Message{HEADER: *ferr.Header}, proto.AckResult(ferr))
+}
+
+//makeMsg make a message to the terminal in the edition the terminal use,
+//流水号在pack时分配
+func (t *Terminal) makeMsg(mid uint16, body []byte) proto.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return proto.Message{
+		HEADER: proto.Header{
+			MID:      mid,
+			Attr:     proto.MakeAttr(t.verFlag, false, proto.EncNone, uint16(len(body))),
+			Version:  t.version,
+			PhoneNum: t.phoneNum,
+		},
+		BODY: body,
 	}
+}
+
+//pack encrypt the body with the terminal public key if the terminal use rsa, then pack the message
+func (t *Terminal) pack(msg proto.Message) []byte {
+	frame, _ := t.packSeq(msg)
+	return frame
+}
 
-	copy(t.phoneNum, []byte(msg.HEADER.PhoneNum))
-	t.seqNum = msg.HEADER.SeqNum
+//packSeq is pack and return the platform sequence number of the message,
+//分包时每个分包占用一个流水号，返回第一个分包的流水号
+func (t *Terminal) packSeq(msg proto.Message) ([]byte, uint16) {
+	t.mu.Lock()
+	pubKey := t.pubKey
+	if !t.encrypt {
+		pubKey = nil
+	}
+	t.mu.Unlock()
+
+	if pubKey != nil {
+		body, err := proto.EncryptBody(pubKey, msg.BODY)
+		if err != nil {
+			fmt.Println("encrypt err:", err)
+			return []byte{}, 0
+		}
+		msg.BODY = body
+		msg.HEADER.SetEncType(proto.EncRSA)
+	}
+	return t.packPlain(msg)
+}
+
+//packPlain is packSeq without encryption
+func (t *Terminal) packPlain(msg proto.Message) ([]byte, uint16) {
+	count := 1
+	if len(msg.BODY) > proto.MaxBodyLen {
+		count = (len(msg.BODY) + proto.MaxBodyLen - 1) / proto.MaxBodyLen
+	}
+	msg.HEADER.SeqNum = t.nextSeq(count)
+
+	return bytes.Join(proto.PackerMulti(msg), nil), msg.HEADER.SeqNum
+}
+
+//platAck make the platform general response for msg
+func (t *Terminal) platAck(msg proto.Message, result uint8) []byte {
+	body, err := codec.Marshal(&PlatAckBody{
+		AckSeqNum: msg.HEADER.SeqNum,
+		AckID:     msg.HEADER.MID,
+		AckResult: result,
+	})
+	if err != nil {
+		fmt.Println("err:", err)
+	}
+
+	return t.pack(t.makeMsg(proto.PlatAck, body))
+}
+
+//loadImei load the imei of the terminal from dev_info by phone number,
+//2013版本的鉴权消息不带IMEI，按注册时登记的手机号查询
+func (t *Terminal) loadImei() {
+	if t.Engine == nil {
+		return
+	}
+
+	devinfo := new(DevInfo)
+	devinfo.PhoneNum = t.GetPhone()
+	is, err := t.Engine.Get(devinfo)
+	if err != nil {
+		fmt.Println("get devinfo err:", err)
+		return
+	}
+	if !is || devinfo.Imei == "" {
+		fmt.Println("no imei of phone:", devinfo.PhoneNum)
+		return
+	}
+
+	t.mu.Lock()
+	t.imei = devinfo.Imei
+	t.mu.Unlock()
+}
+
+//gpsData convert a location body to a gps_data record
+func (t *Terminal) gpsData(gpsInfo *GPSInfoBody) *GPSData {
+	gpsdata := new(GPSData)
+	gpsdata.Imei = t.imei
+	gpsdata.Stamp = time.Now()
+	gpsdata.WarnFlag = gpsInfo.WarnFlag.Raw
+	gpsdata.State = gpsInfo.State.Raw
+	gpsdata.Latitude = gpsInfo.Lat.Micro()
+	gpsdata.Longitude = gpsInfo.Lng.Micro()
+
+	gpsdata.Altitude = gpsInfo.Alt
+	gpsdata.Speed = gpsInfo.Speed
+	gpsdata.Direction = gpsInfo.Dir
+
+	//定位时间取自消息体，补传数据与接收时间不同
+	gpsdata.DataStamp = gpsInfo.Time.Time
+
+	if gpsInfo.State.ACC {
+		gpsdata.AccState = 1
+	}
+	if gpsInfo.State.Fixed {
+		gpsdata.GpsState = 1
+	}
+	gpsdata.LoadState = gpsInfo.State.Load
+	if gpsInfo.State.OilCut {
+		gpsdata.OilCut = 1
+	}
+	if gpsInfo.State.DoorLocked {
+		gpsdata.DoorLock = 1
+	}
+
+	extra := gpsInfo.Extra
+	if extra.Mileage != nil {
+		gpsdata.Mileage = *extra.Mileage
+	}
+	if extra.Fuel != nil {
+		gpsdata.Fuel = *extra.Fuel
+	}
+	if extra.Signal != nil {
+		gpsdata.Signal = *extra.Signal
+	}
+	if extra.Satellite != nil {
+		gpsdata.Satellite = *extra.Satellite
+	}
+	//未解析的附加信息按ID顺序保存原始数据
+	if len(extra.Other) > 0 {
+		raw, err := codec.Marshal(&struct {
+			Other map[uint8][]byte `tlv:"u8,u8"`
+		}{extra.Other})
+		if err == nil {
+			gpsdata.Extra = hex.EncodeToString(raw)
+		}
+	}
+
+	return gpsdata
+}
+
+func (t *Terminal) handleMsg(msg proto.Message) []byte {
+	//消息体经过RSA加密时先用平台私钥解密
+	if msg.HEADER.EncType() == proto.EncRSA {
+		if t.RSAKey == nil {
+			fmt.Println("err:", proto.ErrNoPlatRSAKey)
+			return t.platAck(msg, proto.AckFail)
+		}
+
+		body, err := proto.DecryptBody(t.RSAKey, msg.BODY)
+		if err != nil {
+			fmt.Println("decrypt err:", err)
+			return t.platAck(msg, proto.AckMsgErr)
+		}
+		msg.BODY = body
+		msg.HEADER.SetEncType(proto.EncNone)
+		t.mu.Lock()
+		t.encrypt = true
+		t.mu.Unlock()
+	}
+
+	//未注册或非上行的消息应答不支持
+	mt, ok := proto.Lookup(msg.HEADER.MID)
+	if !ok || mt.Dir != proto.DirUp {
+		return t.platAck(msg, proto.AckUnsupported)
+	}
+
+	body, err := proto.DecodeBody(msg)
+	if err != nil {
+		fmt.Println("err:", err)
+		if msg.HEADER.MID == proto.TermAck {
+			return nil
+		}
+		return t.platAck(msg, proto.AckResult(err))
+	}
+
+	resolved := t.resolve(msg.HEADER.MID, body)
 
 	switch msg.HEADER.MID {
 	case proto.TermAck:
-		reqID := codec.Bytes2Word(msg.BODY[2:4])
-		if reqID == proto.UpdateReq {
-			//ch <- 1
-			//均级命令
+		ack := body.(*TermAckBody)
+		if !resolved {
+			fmt.Printf("unexpected ack id:0x%04X seq:%d result:%d\n", ack.AckID, ack.AckSeqNum, ack.AckResult)
+		}
+	case proto.AttrQueryAck:
+		//查询超时后才到达的应答同样保存
+		if !resolved {
+			t.setAttr(attrBody(body))
+		}
+	case proto.PosQueryAck:
+		gpsdata := t.gpsData(&body.(*PosQueryAckBody).Info)
+
+		_, err = t.Engine.Insert(gpsdata)
+		if err != nil {
+			fmt.Println("insert gps err:", err)
 		}
 	case proto.Register:
 		devinfo := new(DevInfo)
 
-		devinfo.PhoneNum = strings.TrimLeft(utils.HexBuffToString(t.phoneNum), "0")
+		devinfo.PhoneNum = t.phoneNum
 
 		is, _ := t.Engine.Get(devinfo)
 		if !is {
 			return []byte{}
 		}
 
-		var reg RegisterBody
-		_, err := codec.Unmarshal(msg.BODY, &reg)
+		switch reg := body.(type) {
+		case *RegisterBody:
+			devinfo.ProvId, devinfo.CityId = reg.ProID, reg.CityID
+			devinfo.Manuf, devinfo.TermType, devinfo.TermId = reg.ManufID, reg.TermType, reg.TermID
+			devinfo.PlateColor, devinfo.PlateNum = int(reg.LicPlateColor), reg.LicPlate
+		case *RegisterBody2013:
+			devinfo.ProvId, devinfo.CityId = reg.ProID, reg.CityID
+			devinfo.Manuf, devinfo.TermType, devinfo.TermId = reg.ManufID, reg.TermType, reg.TermID
+			devinfo.PlateColor, devinfo.PlateNum = int(reg.LicPlateColor), reg.LicPlate
+		}
+
+		_, err := t.Engine.ID(devinfo.PhoneNum).Cols("prov_id", "city_id", "manuf", "term_type", "term_id", "plate_color", "plate_num").Update(devinfo)
 		if err != nil {
-			fmt.Println("err:", err)
+			fmt.Println("update devinfo err:", err)
 		}
 
-		var body []byte
-		body, err = codec.Marshal(&RegisterAckBody{
+		ackBody, err := codec.Marshal(&RegisterAckBody{
 			AckSeqNum: msg.HEADER.SeqNum,
 			AckResult: 0,
 			AuthKey:   devinfo.Authkey,
@@ -209,138 +676,83 @@ func (t *Terminal) Handler(msg proto.Message) []byte {
 			fmt.Println("err:", err)
 		}
 
-		msgAck := proto.Message{
-			HEADER: proto.Header{
-				MID:      proto.RegisterAck,
-				Attr:     proto.MakeAttr(1, false, 0, uint16(len(body))),
-				Version:  1,
-				PhoneNum: string(t.phoneNum),
-				SeqNum:   t.seqNum,
-			},
-			BODY: body,
-		}
-		return proto.Packer(msgAck)
+		return t.pack(t.makeMsg(proto.RegisterAck, ackBody))
 	case proto.Login:
-		var auth AuthBody
-		_, err := codec.Unmarshal(msg.BODY, &auth)
-		if err != nil {
-			fmt.Println("err:", err)
+		switch auth := body.(type) {
+		case *AuthBody:
+			t.authkey = auth.AuthKey
+			t.tboxver = auth.Version
+			t.mu.Lock()
+			t.imei = auth.Imei
+			t.mu.Unlock()
+		case *AuthBody2013:
+			t.authkey = auth.AuthKey
+			t.loadImei()
 		}
-		t.authkey = auth.AuthKey
-		t.imei = string(auth.Imei)
-		t.tboxver = string(auth.Version)
 
-		var body []byte
-		body, err = codec.Marshal(&PlatAckBody{
-			AckSeqNum: msg.HEADER.SeqNum,
-			AckID:     msg.HEADER.MID,
-			AckResult: 0,
-		})
-		if err != nil {
+		//先应答鉴权，再查询终端属性，查询的应答由读取循环处理所以不能在此等待
+		if err := t.write(t.platAck(msg, proto.AckSuccess)); err != nil {
 			fmt.Println("err:", err)
+			return nil
 		}
-
-		msgAck := proto.Message{
-			HEADER: proto.Header{
-				MID:      proto.PlatAck,
-				Attr:     proto.MakeAttr(1, false, 0, uint16(len(body))),
-				Version:  1,
-				PhoneNum: string(t.phoneNum),
-				SeqNum:   t.seqNum,
-			},
-			BODY: body,
+		if t.beginAttrQuery() {
+			go t.updateAttr()
 		}
-		return proto.Packer(msgAck)
-	case proto.Heartbeat:
-		var err error
-		var body []byte
-		body, err = codec.Marshal(&PlatAckBody{
-			AckSeqNum: msg.HEADER.SeqNum,
-			AckID:     msg.HEADER.MID,
-			AckResult: 0,
-		})
-		if err != nil {
-			fmt.Println("err:", err)
-		}
-
-		msgAck := proto.Message{
-			HEADER: proto.Header{
-				MID:      proto.PlatAck,
-				Attr:     proto.MakeAttr(1, false, 0, uint16(len(body))),
-				Version:  1,
-				PhoneNum: string(t.phoneNum),
-				SeqNum:   t.seqNum,
-			},
-			BODY: body,
-		}
-		return proto.Packer(msgAck)
+		return nil
+	case proto.Heartbeat, proto.Unregister:
+		return t.platAck(msg, proto.AckSuccess)
 	case proto.Gpsinfo:
-		var gpsInfo GPSInfoBody
-		_, err := codec.Unmarshal(msg.BODY, &gpsInfo)
+		gpsdata := t.gpsData(body.(*GPSInfoBody))
+
+		_, err = t.Engine.Insert(gpsdata)
 		if err != nil {
-			fmt.Println("err:", err)
+			fmt.Println("insert gps err:", err)
 		}
 
-		gpsdata := new(GPSData)
-		gpsdata.Imei = t.imei
-		gpsdata.Stamp = time.Now()
-		gpsdata.WarnFlag = gpsInfo.WarnFlag
-		gpsdata.State = gpsInfo.State
-		gpsdata.Latitude = gpsInfo.Lat
-		gpsdata.Longitude = gpsInfo.Lng
-
-		gpsdata.Altitude = gpsInfo.Alt
-		gpsdata.Speed = gpsInfo.Speed
-		gpsdata.Direction = gpsInfo.Dir
-
-		var year, month, day, hour, minute, second uint64
-		year, err = strconv.ParseUint(strconv.FormatUint(uint64(gpsInfo.Time[0]), 16), 10, 8)
-		month, err = strconv.ParseUint(strconv.FormatUint(uint64(gpsInfo.Time[1]), 16), 10, 8)
-		day, err = strconv.ParseUint(strconv.FormatUint(uint64(gpsInfo.Time[2]), 16), 10, 8)
-		hour, err = strconv.ParseUint(strconv.FormatUint(uint64(gpsInfo.Time[3]), 16), 10, 8)
-		minute, err = strconv.ParseUint(strconv.FormatUint(uint64(gpsInfo.Time[4]), 16), 10, 8)
-		second, err = strconv.ParseUint(strconv.FormatUint(uint64(gpsInfo.Time[5]), 16), 10, 8)
-
-		gpsdata.DataStamp = time.Date(int(2000+year), time.Month(month), int(day), int(hour), int(minute), int(second), 0, time.Local)
-
-		if (gpsdata.State & 0x00000001) > 0 {
-			gpsdata.AccState = 1
-		} else {
-			gpsdata.AccState = 0
-		}
+		return t.platAck(msg, proto.AckSuccess)
+	case proto.BatchGps:
+		batch := body.(*BatchGPSBody)
 
-		if (gpsdata.State & 0x00000002) > 0 {
-			gpsdata.GpsState = 1
-		} else {
-			gpsdata.GpsState = 0
+		gpsList := make([]*GPSData, 0, len(batch.Items))
+		for i := range batch.Items {
+			gpsList = append(gpsList, t.gpsData(&batch.Items[i].Info))
 		}
 
-		_, err = t.Engine.Insert(gpsdata)
-		if err != nil {
-			fmt.Println("insert gps err:", err)
+		if len(gpsList) > 0 {
+			_, err = t.Engine.Insert(&gpsList)
+			if err != nil {
+				fmt.Println("insert gps err:", err)
+			}
 		}
 
-		var body []byte
-		body, err = codec.Marshal(&PlatAckBody{
-			AckSeqNum: msg.HEADER.SeqNum,
-			AckID:     msg.HEADER.MID,
-			AckResult: 0,
-		})
-		if err != nil {
+		return t.platAck(msg, proto.AckSuccess)
+	case proto.TermRSA:
+		key := body.(*RSAKeyBody)
+		pubKey := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(key.N),
+			E: int(key.E),
+		}
+		if err := proto.CheckRSAKey(pubKey); err != nil {
 			fmt.Println("err:", err)
+			return t.platAck(msg, proto.AckMsgErr)
+		}
+		t.mu.Lock()
+		t.pubKey = pubKey
+		t.mu.Unlock()
+
+		//终端主动上传公钥时以平台公钥应答，已发送过则通用应答
+		t.mu.Lock()
+		keySent := t.keySent
+		t.mu.Unlock()
+		if t.RSAKey == nil || keySent {
+			return t.platAck(msg, proto.AckSuccess)
 		}
 
-		msgAck := proto.Message{
-			HEADER: proto.Header{
-				MID:      proto.PlatAck,
-				Attr:     proto.MakeAttr(1, false, 0, uint16(len(body))),
-				Version:  1,
-				PhoneNum: string(t.phoneNum),
-				SeqNum:   t.seqNum,
-			},
-			BODY: body,
+		sendbuff, err := t.platKey()
+		if err != nil {
+			fmt.Println("err:", err)
 		}
-		return proto.Packer(msgAck)
+		return sendbuff
 	}
 
 	return nil
@@ -0,0 +1,149 @@
+package term
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"tsp/codec"
+	"tsp/proto"
+)
+
+const testPhone = "13800123456"
+
+//upMsg make a message from the terminal as it is parsed from a frame
+func upMsg(t *testing.T, mid uint16, ver2019 bool, seqNum uint16, body interface{}) proto.Message {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = codec.Marshal(body); err != nil {
+			t.Fatalf("marshal err:%s", err.Error())
+		}
+	}
+
+	var verFlag byte
+	var version uint8
+	if ver2019 {
+		verFlag, version = 1, 1
+	}
+	msg := proto.Message{
+		HEADER: proto.Header{
+			MID:      mid,
+			Attr:     proto.MakeAttr(verFlag, false, proto.EncNone, uint16(len(data))),
+			Version:  version,
+			PhoneNum: testPhone,
+			SeqNum:   seqNum,
+		},
+		BODY: data,
+	}
+
+	msgs, _, err := proto.Filter(proto.Packer(msg))
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("msgs:%v, err:%v", msgs, err)
+	}
+	return msgs[0]
+}
+
+//pipeTerm return a Terminal connected to a net.Pipe and the messages it send to the terminal
+func pipeTerm(t *testing.T, ver2019 bool) (*Terminal, <-chan proto.Message) {
+	platform, device := net.Pipe()
+	term := &Terminal{Conn: platform}
+
+	sent := make(chan proto.Message, 16)
+	go func() {
+		defer close(sent)
+		dec := proto.NewDecoder(device)
+		for {
+			msg, err := dec.Decode()
+			if _, ok := err.(*proto.FrameError); ok {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			sent <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		platform.Close()
+		device.Close()
+	})
+
+	//终端先发送心跳，平台记录手机号和协议版本
+	term.Handler(upMsg(t, proto.Heartbeat, ver2019, 0, nil))
+	return term, sent
+}
+
+func TestMultiAck(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int //分包的接收顺序
+	}{
+		{"in order", []int{0, 1}},
+		{"out of order", []int{1, 0}},
+	}
+
+	for _, tt := range tests {
+		term, _ := pipeTerm(t, true)
+
+		msg := upMsg(t, proto.Heartbeat, true, 10, nil)
+		msg.BODY = make([]byte, proto.MaxBodyLen+10)
+		msg.HEADER.SetBodyLen(len(msg.BODY))
+		frames := proto.PackerMulti(msg)
+
+		//每个分包按自己的流水号应答一次
+		acked := make(map[uint16]int)
+		for _, i := range tt.order {
+			parts, _, err := proto.Filter(frames[i])
+			if err != nil || len(parts) != 1 {
+				t.Fatalf("%s: parts:%v, err:%v", tt.name, parts, err)
+			}
+
+			acks, _, err := proto.Filter(term.Handler(parts[0]))
+			if err != nil || len(acks) != 1 || acks[0].HEADER.MID != proto.PlatAck {
+				t.Fatalf("%s: acks:%v, err:%v", tt.name, acks, err)
+			}
+			var ack PlatAckBody
+			if _, err = codec.Unmarshal(acks[0].BODY, &ack); err != nil {
+				t.Fatal(err)
+			}
+			if ack.AckID != proto.Heartbeat || ack.AckResult != proto.AckSuccess {
+				t.Errorf("%s: ack:%+v", tt.name, ack)
+			}
+			acked[ack.AckSeqNum]++
+		}
+		if len(acked) != 2 || acked[10] != 1 || acked[11] != 1 {
+			t.Errorf("%s: acked:%v", tt.name, acked)
+		}
+	}
+}
+
+func TestSendRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, proto.RSAKeyLen*8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	term, sent := pipeTerm(t, true)
+	term.RSAKey = key
+	written := 0
+	term.OnWrite = func(data []byte) {
+		written++
+	}
+
+	//平台公钥消息同样使用平台流水号，并经过OnWrite记录
+	seqs := make(map[uint16]bool)
+	for i := 0; i < 2; i++ {
+		if err = term.SendRSAKey(); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-sent
+		if msg.HEADER.MID != proto.PlatRSA || msg.HEADER.EncType() != proto.EncNone {
+			t.Fatalf("msg:%+v", msg.HEADER)
+		}
+		seqs[msg.HEADER.SeqNum] = true
+	}
+	if len(seqs) != 2 || written != 2 {
+		t.Errorf("seqs:%v, written:%d", seqs, written)
+	}
+}